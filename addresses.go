@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// the chains whose addresses the guard recognizes
+const (
+	ChainEVM     = "EVM"
+	ChainBitcoin = "Bitcoin"
+	ChainTron    = "Tron"
+	ChainSolana  = "Solana"
+)
+
+// how long the notice with the official addresses stays up in the chat
+const addressNoticeTTL = 2 * time.Minute
+
+// address formats in the order they're tried, the base58 formats overlap so
+// the more specific ones come first
+var addressFormats = []struct {
+	Chain   string
+	Pattern *regexp.Regexp
+}{
+	{ChainEVM, regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)},
+	{ChainBitcoin, regexp.MustCompile(`^(bc1|BC1)[02-9ac-hj-np-zAC-HJ-NP-Z]{11,71}$`)},
+	{ChainTron, regexp.MustCompile(`^T[1-9A-HJ-NP-Za-km-z]{33}$`)},
+	{ChainBitcoin, regexp.MustCompile(`^[13][1-9A-HJ-NP-Za-km-z]{25,34}$`)},
+	{ChainSolana, regexp.MustCompile(`^[1-9A-HJ-NP-Za-km-z]{32,44}$`)},
+}
+
+// a wallet or contract address found in a message
+type CryptoAddress struct {
+	Chain   string
+	Address string
+}
+
+func (a CryptoAddress) String() string {
+	return fmt.Sprintf("%s: %s", a.Chain, a.Address)
+}
+
+// whether the word mixes digits with upper and lower case letters like a
+// base58 address does, so long ordinary words aren't taken for one
+func looksEncoded(word string) bool {
+	var digit, upper, lower bool
+	for _, r := range word {
+		digit = digit || unicode.IsDigit(r)
+		upper = upper || unicode.IsUpper(r)
+		lower = lower || unicode.IsLower(r)
+	}
+	return digit && upper && lower
+}
+
+// the chain of the address, "" if the word isn't one
+func addressChain(word string) string {
+	for _, f := range addressFormats {
+		if !f.Pattern.MatchString(word) {
+			continue
+		}
+		if f.Chain != ChainEVM && !strings.HasPrefix(strings.ToLower(word), "bc1") && !looksEncoded(word) {
+			return ""
+		}
+		return f.Chain
+	}
+	return ""
+}
+
+// hex and bech32 addresses aren't case sensitive so they're stored lowercase
+func normalizeAddress(a CryptoAddress) string {
+	if a.Chain == ChainEVM || strings.HasPrefix(strings.ToLower(a.Address), "bc1") {
+		return strings.ToLower(a.Address)
+	}
+	return a.Address
+}
+
+// every address in the text, in the order they appear
+func findAddresses(text string) []CryptoAddress {
+	addresses := []CryptoAddress{}
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if chain := addressChain(word); chain != "" {
+			addresses = append(addresses, CryptoAddress{Chain: chain, Address: word})
+		}
+	}
+	return addresses
+}
+
+// the chat's official addresses mapped from their normalized form
+func getAllowedAddresses(chatID int64) map[string]CryptoAddress {
+	data, err := R.HGetAll(fmt.Sprintf("chat:%d:addressAllowlist", chatID)).Result()
+	if err != nil {
+		LogE.Printf("couldn't get allowed addresses for chat %d: %s", chatID, err)
+	}
+	allowed := map[string]CryptoAddress{}
+	for address, chain := range data {
+		allowed[address] = CryptoAddress{Chain: chain, Address: address}
+	}
+	return allowed
+}
+
+func officialAddresses(allowed map[string]CryptoAddress) []string {
+	lines := []string{}
+	for _, a := range allowed {
+		lines = append(lines, a.String())
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func addressGuardEnabled(chatID int64) bool {
+	enabled, err := R.Get(fmt.Sprintf("chat:%d:addressGuard", chatID)).Int64()
+	return err == nil && enabled != 0
+}
+
+// deletes a message from anyone other than an admin that has an address
+// the admins haven't approved and reminds the chat of the official ones,
+// returns whether it was deleted
+func removeMsgIfUnapprovedAddress(m *tb.Message) bool {
+	text := strings.TrimSpace(m.Text + " " + m.Caption)
+	if text == "" || !addressGuardEnabled(m.Chat.ID) || isKnownAdmin(m.Chat.ID, m.Sender.ID) {
+		return false
+	}
+	allowed := getAllowedAddresses(m.Chat.ID)
+	for _, a := range findAddresses(text) {
+		if _, ok := allowed[normalizeAddress(a)]; ok {
+			continue
+		}
+		B.Delete(m)
+		LogI.Printf("deleted %s address from user %d in chat %d", a.Chain, m.Sender.ID, m.Chat.ID)
+		audit(AuditEntry{ChatID: m.Chat.ID, Action: AuditDelete, Reason: "posted " + a.String(),
+			Link: messageLink(m)}.against(m.Sender))
+		notice := fmt.Sprintf("%s, only addresses the admins have approved can be posted here. "+
+			"Never send funds to an address someone posts or messages you", displayName(m.Sender))
+		if official := officialAddresses(allowed); len(official) > 0 {
+			notice += ", the official addresses are:\n" + strings.Join(official, "\n")
+		}
+		if sent, err := B.Send(m.Chat, notice, tb.NoPreview); err == nil {
+			deleteMessageLater(sent, addressNoticeTTL)
+		}
+		warnFromFilter(m, "posting an unapproved "+a.Chain+" address")
+		return true
+	}
+	return false
+}
+
+func toggleAddressGuard(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	key := fmt.Sprintf("chat:%d:addressGuard", chatID)
+	enabled, _ := R.Get(key).Int64()
+	enabled = enabled ^ 1
+	if err = R.Set(key, enabled, 0).Err(); err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't toggle address guard for chat %d", chatID)
+	}
+	if enabled != 0 {
+		B.Send(sender, fmt.Sprintf("Wallet and contract addresses posted by anyone other than the admins of %s "+
+			"will be deleted unless they're allowed, make sure I'm an admin that can delete messages", chatTitle))
+	} else {
+		B.Send(sender, fmt.Sprintf("Anyone in %s can post addresses again", chatTitle))
+	}
+	return
+}
+
+// receives the official addresses separated by spaces, commas or new lines
+func allowAddresses(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	addresses := map[string]interface{}{}
+	for _, field := range strings.FieldsFunc(ms[0].Text, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n'
+	}) {
+		chain := addressChain(field)
+		if chain == "" {
+			B.Send(sender, fmt.Sprintf("No addresses were added, %s isn't an EVM, Bitcoin, Tron or Solana address", field))
+			return nil
+		}
+		addresses[normalizeAddress(CryptoAddress{Chain: chain, Address: field})] = chain
+	}
+	if len(addresses) == 0 {
+		B.Send(sender, "No addresses were added, you need to send at least one address")
+		return
+	}
+	if err = R.HMSet(fmt.Sprintf("chat:%d:addressAllowlist", chatID), addresses).Err(); err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't allow addresses in chat %d", chatID)
+	}
+	B.Send(sender, fmt.Sprintf("Added %d official addresses to %s", len(addresses), chatTitle))
+	return
+}
+
+func removeAddress(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, _, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	address := strings.TrimSpace(ms[0].Text)
+	if chain := addressChain(address); chain != "" {
+		address = normalizeAddress(CryptoAddress{Chain: chain, Address: address})
+	}
+	removed, err := R.HDel(fmt.Sprintf("chat:%d:addressAllowlist", chatID), address).Result()
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't remove address from chat %d", chatID)
+	}
+	if removed == 0 {
+		B.Send(sender, address+" isn't one of the official addresses")
+		return
+	}
+	B.Send(sender, address+" has been removed from the official addresses")
+	return
+}
+
+func viewAddresses(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	official := officialAddresses(getAllowedAddresses(int64(chatID)))
+	guard := "off"
+	if addressGuardEnabled(int64(chatID)) {
+		guard = "on"
+	}
+	if len(official) == 0 {
+		B.Send(sender, fmt.Sprintf("%s doesn't have any official addresses, the address guard is %s", chatTitle, guard))
+		return
+	}
+	B.Send(sender, fmt.Sprintf("Official addresses for %s (the address guard is %s)\n%s",
+		chatTitle, guard, strings.Join(official, "\n")), tb.NoPreview)
+	return
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// the kinds of action recorded in a chat's audit log
+const (
+	AuditBan            = "Ban"
+	AuditUnban          = "Unban"
+	AuditKick           = "Kick"
+	AuditMute           = "Mute"
+	AuditUnmute         = "Unmute"
+	AuditWarn           = "Warn"
+	AuditUnwarn         = "Warning Removed"
+	AuditDelete         = "Message Deleted"
+	AuditBotBlocked     = "Bot Blocked"
+	AuditBotWhitelisted = "Bot Whitelisted"
+	AuditCaptchaFailed  = "Captcha Failed"
+	AuditAdminAdded     = "Admin Added"
+	AuditAdminRemoved   = "Admin Removed"
+	AuditCommandChanged = "Command Changed"
+	AuditLockdown       = "Lockdown"
+	AuditUnlock         = "Unlock"
+	AuditNightStart     = "Night Mode Started"
+	AuditNightEnd       = "Night Mode Ended"
+	AuditSettingsCopied = "Settings Copied"
+)
+
+// roughly how many entries each chat's audit log keeps
+const auditLogLength = 10000
+
+// number of entries shown by /viewauditlog
+const auditEntriesShown = 20
+
+// something that happened in a chat, an empty actor means beru did it on its own
+type AuditEntry struct {
+	ChatID   int64
+	Action   string
+	ActorID  int
+	Actor    string
+	TargetID int
+	Target   string
+	Reason   string
+	// link to the message the action was about, empty if there isn't one
+	Link string
+	// unix time in milliseconds, only set on entries read back from the log
+	Time int64
+}
+
+func (e AuditEntry) String() string {
+	lines := []string{"#" + strings.ReplaceAll(strings.ToLower(e.Action), " ", "_")}
+	lines = append(lines, "By: "+e.actor())
+	if e.Target != "" {
+		target := e.Target
+		if e.TargetID != 0 {
+			target += fmt.Sprintf(" [%d]", e.TargetID)
+		}
+		lines = append(lines, "Target: "+target)
+	}
+	if e.Reason != "" {
+		lines = append(lines, "Reason: "+e.Reason)
+	}
+	if e.Link != "" {
+		lines = append(lines, "Context: "+e.Link)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e AuditEntry) actor() string {
+	if e.Actor == "" {
+		return "Beru"
+	}
+	return fmt.Sprintf("%s [%d]", e.Actor, e.ActorID)
+}
+
+func auditLogKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:auditLog", chatID)
+}
+
+// fills in who took an action, a nil user means beru took it
+func (e AuditEntry) by(u *tb.User) AuditEntry {
+	if u != nil {
+		e.ActorID, e.Actor = u.ID, displayName(u)
+	}
+	return e
+}
+
+// fills in who an action was taken against
+func (e AuditEntry) against(u *tb.User) AuditEntry {
+	e.TargetID, e.Target = u.ID, displayName(u)
+	return e
+}
+
+// link to a message in a supergroup or public chat, basic groups have none
+func messageLink(m *tb.Message) string {
+	if m == nil || m.Chat == nil {
+		return ""
+	}
+	if m.Chat.Username != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", m.Chat.Username, m.ID)
+	}
+	if id := strconv.FormatInt(m.Chat.ID, 10); strings.HasPrefix(id, "-100") {
+		return fmt.Sprintf("https://t.me/c/%s/%d", strings.TrimPrefix(id, "-100"), m.ID)
+	}
+	return ""
+}
+
+// adds the entry to the chat's audit log and posts it to the chat's log channel if it has one
+func audit(e AuditEntry) {
+	err := R.XAdd(&redis.XAddArgs{
+		Stream:       auditLogKey(e.ChatID),
+		MaxLenApprox: auditLogLength,
+		Values: map[string]interface{}{
+			"action":   e.Action,
+			"actorID":  e.ActorID,
+			"actor":    e.Actor,
+			"targetID": e.TargetID,
+			"target":   e.Target,
+			"reason":   e.Reason,
+			"link":     e.Link,
+		},
+	}).Err()
+	if err != nil {
+		LogE.Printf("couldn't add %s to the audit log of chat %d: %s", e.Action, e.ChatID, err)
+	}
+	channelID, err := R.Get(fmt.Sprintf("chat:%d:auditChannel", e.ChatID)).Int64()
+	if err != nil {
+		return
+	}
+	title, _ := getChatTitle(int(e.ChatID))
+	text := e.String()
+	if title != "" {
+		text = title + "\n" + text
+	}
+	if _, err := B.Send(&tb.Chat{ID: channelID}, text, &tb.SendOptions{DisableWebPagePreview: true}); err != nil {
+		LogW.Printf("couldn't post to the audit channel %d of chat %d: %s", channelID, e.ChatID, err)
+	}
+}
+
+// the most recent entries in the chat's audit log, newest first
+func getAuditLog(chatID int64, count int64) ([]AuditEntry, error) {
+	messages, err := R.XRevRangeN(auditLogKey(chatID), "+", "-", count).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read the audit log of chat %d", chatID)
+	}
+	entries := []AuditEntry{}
+	for _, msg := range messages {
+		value := func(field string) string {
+			s, _ := msg.Values[field].(string)
+			return s
+		}
+		e := AuditEntry{ChatID: chatID, Action: value("action"), Actor: value("actor"), Target: value("target"),
+			Reason: value("reason"), Link: value("link")}
+		e.ActorID, _ = strconv.Atoi(value("actorID"))
+		e.TargetID, _ = strconv.Atoi(value("targetID"))
+		// stream IDs start with the time in milliseconds
+		e.Time, _ = strconv.ParseInt(strings.SplitN(msg.ID, "-", 2)[0], 10, 64)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// receives a message forwarded from the log channel, its ID or None to stop posting there
+func setAuditLog(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	key := fmt.Sprintf("chat:%d:auditChannel", chatID)
+	if ms[0].Text == NoNotice {
+		if err = R.Del(key).Err(); err != nil {
+			B.Send(sender, ErrorResponse)
+			return errors.Wrapf(err, "couldn't remove the audit channel of chat %d", chatID)
+		}
+		B.Send(sender, "Moderation actions in "+chatTitle+" will only be kept in the audit log")
+		return
+	}
+	var channelID int64
+	if ms[0].OriginalChat != nil {
+		channelID = ms[0].OriginalChat.ID
+	} else if channelID, err = strconv.ParseInt(strings.TrimSpace(ms[0].Text), 10, 64); err != nil {
+		B.Send(sender, "Forward me a message from the channel or send its ID, like -1001234567890")
+		return nil
+	}
+	if _, err := B.Send(&tb.Chat{ID: channelID}, "Beru will post moderation actions in "+chatTitle+" here"); err != nil {
+		B.Send(sender, "I couldn't post there, add me to the channel or group as an admin that can post messages first")
+		return nil
+	}
+	if err = R.Set(key, channelID, 0).Err(); err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't save the audit channel of chat %d", chatID)
+	}
+	B.Send(sender, "Moderation actions in "+chatTitle+" will be posted to the log channel")
+	return
+}
+
+func viewAuditLog(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	entries, err := getAuditLog(int64(chatID), auditEntriesShown)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return err
+	}
+	if len(entries) == 0 {
+		B.Send(sender, chatTitle+" doesn't have anything in its audit log yet")
+		return
+	}
+	lines := []string{fmt.Sprintf("The last %d actions in %s, newest first", len(entries), chatTitle)}
+	for _, e := range entries {
+		when := time.Unix(0, e.Time*int64(time.Millisecond)).UTC().Format("Jan 2 15:04 MST")
+		line := fmt.Sprintf("%s: %s by %s", when, e.Action, e.actor())
+		if e.Target != "" {
+			line += " against " + e.Target
+		}
+		if e.Reason != "" {
+			line += " (" + e.Reason + ")"
+		}
+		lines = append(lines, line)
+	}
+	B.Send(sender, strings.Join(lines, "\n"), &tb.SendOptions{DisableWebPagePreview: true})
+	return
+}
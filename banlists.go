@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// a ban list is named by its owner and shared by the chats subscribed to it,
+// it's referred to as "ownerID:name" so different owners can reuse names
+func banListRef(ownerID int, name string) string {
+	return fmt.Sprintf("%d:%s", ownerID, name)
+}
+
+func banListName(ref string) string {
+	parts := strings.SplitN(ref, ":", 2)
+	return parts[len(parts)-1]
+}
+
+func banListKey(ref string, field string) string {
+	return fmt.Sprintf("banList:%s:%s", ref, field)
+}
+
+// imports are banned from every subscribed chat straight away, so they're
+// kept small enough not to run into telegram's rate limits
+const (
+	maxBanListFileSize = 256 * 1024
+	maxImportedBans    = 500
+)
+
+// what /exportbanlist sends and /importbanlist reads, bans maps user IDs to reasons
+type BanListFile struct {
+	Name string            `json:"name"`
+	Bans map[string]string `json:"bans"`
+}
+
+func getBanLists(ownerID int) []string {
+	names, err := R.SMembers(fmt.Sprintf("user:%d:banLists", ownerID)).Result()
+	if err != nil {
+		LogE.Printf("couldn't get ban lists of user %d: %s", ownerID, err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func banFromList(chatID int64, u *tb.User, ref string, reason string) {
+	if err := B.Ban(&tb.Chat{ID: chatID}, &tb.ChatMember{User: u, RestrictedUntil: tb.Forever()}); err != nil {
+		LogW.Printf("couldn't ban user %d from chat %d for ban list %s: %s", u.ID, chatID, ref, err)
+		return
+	}
+	audit(AuditEntry{ChatID: chatID, Action: AuditBan,
+		Reason: strings.TrimSpace("on ban list " + banListName(ref) + " " + reason)}.against(u))
+}
+
+// adds the user to every ban list the chat subscribes to and bans them
+// from the other chats subscribed to those lists
+func propagateBan(chat *tb.Chat, u *tb.User, reason string) {
+	refs, _ := R.SMembers(fmt.Sprintf("chat:%d:banLists", chat.ID)).Result()
+	for _, ref := range refs {
+		if err := R.HSet(banListKey(ref, "users"), strconv.Itoa(u.ID), reason).Err(); err != nil {
+			LogE.Printf("couldn't add user %d to ban list %s: %s", u.ID, ref, err)
+			continue
+		}
+		chats, _ := R.SMembers(banListKey(ref, "chats")).Result()
+		for _, c := range chats {
+			if chatID, _ := strconv.ParseInt(c, 10, 64); chatID != chat.ID {
+				banFromList(chatID, u, ref, reason)
+			}
+		}
+	}
+}
+
+// takes the user off the chat's ban lists and unbans them from the other
+// chats on those lists, lists they weren't on are left alone
+func propagateUnban(chat *tb.Chat, u *tb.User) {
+	refs, _ := R.SMembers(fmt.Sprintf("chat:%d:banLists", chat.ID)).Result()
+	for _, ref := range refs {
+		if R.HDel(banListKey(ref, "users"), strconv.Itoa(u.ID)).Val() == 0 {
+			continue
+		}
+		chats, _ := R.SMembers(banListKey(ref, "chats")).Result()
+		for _, c := range chats {
+			chatID, _ := strconv.ParseInt(c, 10, 64)
+			if chatID == chat.ID {
+				continue
+			}
+			if err := B.Unban(&tb.Chat{ID: chatID}, u); err != nil {
+				LogW.Printf("couldn't unban user %d from chat %d for ban list %s: %s", u.ID, chatID, ref, err)
+				continue
+			}
+			audit(AuditEntry{ChatID: chatID, Action: AuditUnban, Reason: "taken off ban list " + banListName(ref)}.against(u))
+		}
+	}
+}
+
+// bans a user that joined while on one of the chat's ban lists,
+// returns whether they were
+func rejectListedUser(m *tb.Message, u *tb.User) bool {
+	refs, _ := R.SMembers(fmt.Sprintf("chat:%d:banLists", m.Chat.ID)).Result()
+	for _, ref := range refs {
+		reason, err := R.HGet(banListKey(ref, "users"), strconv.Itoa(u.ID)).Result()
+		if err != nil {
+			continue
+		}
+		LogI.Printf("rejected user %d from chat %d, they're on ban list %s", u.ID, m.Chat.ID, ref)
+		banFromList(m.Chat.ID, u, ref, reason)
+		B.Delete(m)
+		return true
+	}
+	return false
+}
+
+// /unban as a reply or with a username, it also takes them off the chat's ban lists
+func unbanCommand(m *tb.Message) {
+	u, reason, ok := moderationTarget(m, "unbanned")
+	if !ok {
+		return
+	}
+	if err := B.Unban(m.Chat, u); err != nil {
+		LogE.Printf("couldn't unban user %d from chat %d: %s", u.ID, m.Chat.ID, err)
+		B.Reply(m, "I couldn't unban them, make sure I'm an admin that can ban users")
+		return
+	}
+	audit(AuditEntry{ChatID: m.Chat.ID, Action: AuditUnban, Reason: reason, Link: messageLink(m)}.by(m.Sender).against(u))
+	propagateUnban(m.Chat, u)
+	confirmAction(m, displayName(u)+" has been unbanned by "+displayName(m.Sender), reason, "", u)
+}
+
+// receives the name of a new ban list, the active chat is subscribed to it
+func addBanList(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	name := strings.TrimSpace(ms[0].Text)
+	if name == "" || strings.HasPrefix(name, "/") {
+		B.Send(sender, "The ban list wasn't added, give it a name that doesn't start with /")
+		return
+	}
+	ref := banListRef(sender.ID, name)
+	_, err = R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SAdd(fmt.Sprintf("user:%d:banLists", sender.ID), name)
+		pipe.SAdd(banListKey(ref, "chats"), chatID)
+		pipe.SAdd(fmt.Sprintf("chat:%d:banLists", chatID), ref)
+		return nil
+	})
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't add ban list %s", ref)
+	}
+	B.Send(sender, fmt.Sprintf("%s is subscribed to the ban list %s, use /togglebanlist to subscribe your other chats. "+
+		"Anyone banned in one of them will be banned from the rest", chatTitle, name))
+	return
+}
+
+// subscribes the active chat to one of the sender's ban lists or unsubscribes it
+func toggleBanList(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	name := ms[0].Text
+	if ok, _ := R.SIsMember(fmt.Sprintf("user:%d:banLists", sender.ID), name).Result(); !ok {
+		B.Send(sender, name+" isn't one of your ban lists")
+		return
+	}
+	ref := banListRef(sender.ID, name)
+	chatListsKey := fmt.Sprintf("chat:%d:banLists", chatID)
+	if subscribed, _ := R.SIsMember(chatListsKey, ref).Result(); subscribed {
+		_, err = R.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.SRem(banListKey(ref, "chats"), chatID)
+			pipe.SRem(chatListsKey, ref)
+			return nil
+		})
+		if err != nil {
+			B.Send(sender, ErrorResponse)
+			return errors.Wrapf(err, "couldn't unsubscribe chat %d from ban list %s", chatID, ref)
+		}
+		B.Send(sender, fmt.Sprintf("%s is no longer subscribed to the ban list %s", chatTitle, name))
+		return
+	}
+	_, err = R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SAdd(banListKey(ref, "chats"), chatID)
+		pipe.SAdd(chatListsKey, ref)
+		return nil
+	})
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't subscribe chat %d to ban list %s", chatID, ref)
+	}
+	B.Send(sender, fmt.Sprintf("%s is now subscribed to the ban list %s, users on it will be banned when they join",
+		chatTitle, name))
+	return
+}
+
+func viewBanLists(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	names := getBanLists(sender.ID)
+	if len(names) == 0 {
+		B.Send(sender, "You don't have any ban lists, add one with /addbanlist")
+		return
+	}
+	lines := []string{"Your ban lists"}
+	for _, name := range names {
+		ref := banListRef(sender.ID, name)
+		count := R.HLen(banListKey(ref, "users")).Val()
+		chats, _ := R.SMembers(banListKey(ref, "chats")).Result()
+		titles := []string{}
+		for _, c := range chats {
+			id, _ := strconv.Atoi(c)
+			title, _ := getChatTitle(id)
+			titles = append(titles, title)
+		}
+		sort.Strings(titles)
+		lines = append(lines, fmt.Sprintf("\n%s: %d users\nSubscribed: %s", name, count, strings.Join(titles, ", ")))
+	}
+	B.Send(sender, strings.Join(lines, "\n"))
+	return
+}
+
+func exportBanList(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	name := ms[0].Text
+	if ok, _ := R.SIsMember(fmt.Sprintf("user:%d:banLists", sender.ID), name).Result(); !ok {
+		B.Send(sender, name+" isn't one of your ban lists")
+		return
+	}
+	bans, err := R.HGetAll(banListKey(banListRef(sender.ID, name), "users")).Result()
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't get ban list %s of user %d", name, sender.ID)
+	}
+	data, err := json.MarshalIndent(BanListFile{Name: name, Bans: bans}, "", "  ")
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't encode ban list file")
+	}
+	doc := &tb.Document{
+		File:     tb.FromReader(bytes.NewReader(data)),
+		FileName: "banlist.json",
+		Caption:  fmt.Sprintf("%d users exported from the ban list %s", len(bans), name),
+	}
+	if _, err = B.Send(sender, doc); err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't send ban list file")
+	}
+	return
+}
+
+func readBanListFile(m *tb.Message) (BanListFile, error) {
+	f := BanListFile{}
+	if m.Document == nil {
+		return f, errors.New("message has no document attached")
+	}
+	if m.Document.FileSize > maxBanListFileSize {
+		return f, errors.Errorf("it's bigger than %d KB", maxBanListFileSize/1024)
+	}
+	rc, err := B.GetFile(&m.Document.File)
+	if err != nil {
+		return f, errors.Wrap(err, "couldn't download document")
+	}
+	defer rc.Close()
+	// the size telegram reports can't be relied on, so stop reading past the limit
+	data, err := ioutil.ReadAll(io.LimitReader(rc, maxBanListFileSize+1))
+	if err != nil {
+		return f, errors.Wrap(err, "couldn't read document")
+	}
+	if len(data) > maxBanListFileSize {
+		return f, errors.Errorf("it's bigger than %d KB", maxBanListFileSize/1024)
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, errors.Wrap(err, "couldn't parse ban list file")
+	}
+	if len(f.Bans) == 0 {
+		return f, errors.New("ban list file doesn't contain any users")
+	}
+	if len(f.Bans) > maxImportedBans {
+		return f, errors.Errorf("it has %d users and at most %d can be imported at once", len(f.Bans), maxImportedBans)
+	}
+	for id := range f.Bans {
+		if _, err := strconv.Atoi(id); err != nil {
+			return f, errors.Errorf("%s isn't a user ID", id)
+		}
+	}
+	return f, nil
+}
+
+// receives the ban list and an exported file, everyone in the file is
+// added to the list and banned from its chats
+func importBanList(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	name := ms[0].Text
+	if ok, _ := R.SIsMember(fmt.Sprintf("user:%d:banLists", sender.ID), name).Result(); !ok {
+		B.Send(sender, name+" isn't one of your ban lists")
+		return
+	}
+	f, err := readBanListFile(ms[1])
+	if err != nil {
+		B.Send(sender, fmt.Sprintf("I couldn't read that file: %s", err))
+		return nil
+	}
+	ref := banListRef(sender.ID, name)
+	bans := map[string]interface{}{}
+	for id, reason := range f.Bans {
+		bans[id] = reason
+	}
+	if err = R.HMSet(banListKey(ref, "users"), bans).Err(); err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't import into ban list %s", ref)
+	}
+	chats, _ := R.SMembers(banListKey(ref, "chats")).Result()
+	for _, c := range chats {
+		chatID, _ := strconv.ParseInt(c, 10, 64)
+		for id, reason := range f.Bans {
+			userID, _ := strconv.Atoi(id)
+			banFromList(chatID, knownUser(userID), ref, reason)
+		}
+	}
+	B.Send(sender, fmt.Sprintf("Added %d users to the ban list %s and banned them from its %d chats",
+		len(f.Bans), name, len(chats)))
+	return
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// what happens to a bot that isn't whitelisted when it joins
+const (
+	BotActionBan         = "Ban"
+	BotActionKick        = "Kick"
+	BotActionBanAndAdder = "Ban Bot and Adder"
+)
+
+var BotActionButtons = [][]string{{BotActionBan, BotActionKick}, {BotActionBanAndAdder}}
+
+// posted when a chat hasn't set its own notice
+const DefaultBlockedBotNotice = "{{.Bot}} was removed because it isn't on the whitelist"
+
+// answer that turns the blocked bot notice off
+const NoNotice = "None"
+
+// the values available to the blocked bot notice template
+type BlockedBotContext struct {
+	Bot       string
+	AddedBy   string
+	ChatTitle string
+}
+
+// hash of lowercased bot usernames to IDs for every bot beru has seen
+const botUsernamesKey = "beru:botUsernames"
+
+// inline button that whitelists a blocked bot, its data is "chatID:botID"
+var whitelistBotButton = tb.InlineButton{Unique: "whitelistbot", Text: "Whitelist"}
+
+// a bot that was removed from a chat because it wasn't whitelisted
+type BlockedBot struct {
+	ID          int
+	Username    string
+	AddedBy     int
+	AddedByName string
+	Time        int64
+}
+
+func (b BlockedBot) String() string {
+	when := time.Unix(b.Time, 0).UTC().Format("Jan 2 15:04 MST")
+	if b.AddedByName == "" {
+		return fmt.Sprintf("%s joined on %s", botLabel(b.ID), when)
+	}
+	return fmt.Sprintf("%s added by %s on %s", botLabel(b.ID), b.AddedByName, when)
+}
+
+// the user a join message is about, telebot sets UserJoined
+// once for each user when several join at once
+func joinedUser(m *tb.Message) *tb.User {
+	if m.UserJoined != nil {
+		return m.UserJoined
+	}
+	return m.Sender
+}
+
+// keeps the bot's details so it can later be found by username
+func rememberBot(u *tb.User) {
+	if !u.IsBot {
+		return
+	}
+	R.Set(fmt.Sprintf("user:%d:info", u.ID), EncodeUser(u), 0)
+	if u.Username != "" {
+		R.HSet(botUsernamesKey, strings.ToLower(u.Username), u.ID)
+	}
+}
+
+// @username of a bot if it's known, otherwise its ID
+func botLabel(botID int) string {
+	if name, err := getUserName(botID); err == nil && name != "" {
+		return "@" + name
+	}
+	return strconv.Itoa(botID)
+}
+
+// whether beru has seen the user and knows it's a bot, IDs typed in by an
+// admin could belong to anyone
+func isKnownBot(userID int) bool {
+	data, err := R.Get(fmt.Sprintf("user:%d:info", userID)).Bytes()
+	return err == nil && DecodeUser(data).IsBot
+}
+
+// works out the ID of a bot from a forwarded message, an ID or a username
+// beru has seen before, returns 0 if it can't be resolved yet
+func resolveBot(m *tb.Message) (int, string, error) {
+	if m.OriginalSender != nil {
+		if !m.OriginalSender.IsBot {
+			return 0, "", errors.Errorf("%s is not a bot", m.OriginalSender.FirstName)
+		}
+		rememberBot(m.OriginalSender)
+		return m.OriginalSender.ID, m.OriginalSender.Username, nil
+	}
+	text := strings.TrimSpace(m.Text)
+	if id, err := strconv.Atoi(text); err == nil {
+		return id, "", nil
+	}
+	username := strings.ToLower(strings.TrimPrefix(text, "@"))
+	if username == "" || strings.ContainsAny(username, " \n") {
+		return 0, "", errors.Errorf("%s isn't a bot username", text)
+	}
+	id, err := R.HGet(botUsernamesKey, username).Int()
+	if err != nil {
+		return 0, username, nil
+	}
+	return id, username, nil
+}
+
+// bots are whitelisted by ID, usernames in whitelists from before IDs were
+// stored are swapped for the bot's ID the first time it joins
+func isWhitelistedBot(chatID int64, u *tb.User) bool {
+	whitelistKey := fmt.Sprintf("chat:%d:botWhitelist", chatID)
+	if ok, _ := R.SIsMember(whitelistKey, u.ID).Result(); ok {
+		return true
+	}
+	if u.Username == "" {
+		return false
+	}
+	if legacy, _ := R.SIsMember(whitelistKey, u.Username).Result(); !legacy {
+		return false
+	}
+	R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SRem(whitelistKey, u.Username)
+		pipe.SAdd(whitelistKey, u.ID)
+		return nil
+	})
+	return true
+}
+
+func whitelistBot(chatID int64, botID int) error {
+	_, err := R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SAdd(fmt.Sprintf("chat:%d:botWhitelist", chatID), botID)
+		pipe.HDel(fmt.Sprintf("chat:%d:blockedBots", chatID), strconv.Itoa(botID))
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't whitelist bot %d in chat %d", botID, chatID)
+	}
+	B.Unban(&tb.Chat{ID: chatID}, &tb.User{ID: botID})
+	return nil
+}
+
+// records that the bot was removed so an admin can whitelist it later
+func recordBlockedBot(chatID int64, bot *tb.User, adder *tb.User) {
+	blocked := BlockedBot{
+		ID:       bot.ID,
+		Username: bot.Username,
+		Time:     time.Now().Unix(),
+	}
+	if adder != nil && adder.ID != bot.ID {
+		blocked.AddedBy = adder.ID
+		blocked.AddedByName = displayName(adder)
+	}
+	key := fmt.Sprintf("chat:%d:blockedBots", chatID)
+	if err := R.HSet(key, strconv.Itoa(bot.ID), EncodeBlockedBot(&blocked)).Err(); err != nil {
+		LogE.Printf("couldn't record blocked bot %d in chat %d: %s", bot.ID, chatID, err)
+	}
+	LogI.Printf("blocked bot %s (%d) from chat %d", bot.Username, bot.ID, chatID)
+}
+
+func getBlockedBots(chatID int64) ([]BlockedBot, error) {
+	data, err := R.HGetAll(fmt.Sprintf("chat:%d:blockedBots", chatID)).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't get blocked bots for chat %d", chatID)
+	}
+	bots := []BlockedBot{}
+	for _, d := range data {
+		bots = append(bots, DecodeBlockedBot([]byte(d)))
+	}
+	// most recently blocked first
+	sort.Slice(bots, func(i, j int) bool { return bots[i].Time > bots[j].Time })
+	return bots, nil
+}
+
+func getWhitelistBotMarkup(chatID int64, botID int) *tb.ReplyMarkup {
+	button := whitelistBotButton
+	button.Text = "Whitelist " + botLabel(botID)
+	button.Data = fmt.Sprintf("%d:%d", chatID, botID)
+	return &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{{button}}}
+}
+
+// removes a bot that isn't whitelisted the way the chat is set up to,
+// then posts the chat's notice if it has one
+func blockBot(m *tb.Message, bot *tb.User) {
+	key := fmt.Sprintf("chat:%d:blockedBot", m.Chat.ID)
+	settings, _ := R.HGetAll(key).Result()
+	adder := m.Sender
+	if adder != nil && adder.ID == bot.ID {
+		adder = nil
+	}
+	switch settings["action"] {
+	case BotActionKick:
+		kickMember(m.Chat, bot)
+	case BotActionBanAndAdder:
+		B.Ban(m.Chat, &tb.ChatMember{User: bot, RestrictedUntil: tb.Forever()})
+		if adder != nil && !isChatAdmin(m.Chat.ID, adder.ID) {
+			B.Ban(m.Chat, &tb.ChatMember{User: adder, RestrictedUntil: tb.Forever()})
+			LogI.Printf("banned user %d for adding bot %d to chat %d", adder.ID, bot.ID, m.Chat.ID)
+			audit(AuditEntry{ChatID: m.Chat.ID, Action: AuditBan, Reason: "added " + botLabel(bot.ID),
+				Link: messageLink(m)}.against(adder))
+			propagateBan(m.Chat, adder, "added "+botLabel(bot.ID))
+		}
+	default:
+		B.Ban(m.Chat, &tb.ChatMember{User: bot, RestrictedUntil: tb.Forever()})
+	}
+	recordBlockedBot(m.Chat.ID, bot, adder)
+	entry := AuditEntry{ChatID: m.Chat.ID, Action: AuditBotBlocked, Reason: "not whitelisted", Link: messageLink(m)}.against(bot)
+	if adder != nil {
+		entry.Reason += ", added by " + displayName(adder)
+	}
+	audit(entry)
+
+	notice, ok := settings["notice"]
+	if !ok {
+		notice = DefaultBlockedBotNotice
+	}
+	if notice == "" {
+		return
+	}
+	data := BlockedBotContext{Bot: botLabel(bot.ID), ChatTitle: m.Chat.Title}
+	if adder != nil {
+		data.AddedBy = displayName(adder)
+	}
+	text, err := renderTemplate("blockedBot", notice, data)
+	if err != nil {
+		LogE.Printf("couldn't render blocked bot notice for chat %d: %s", m.Chat.ID, err)
+		return
+	}
+	sent, err := B.Send(m.Chat, text, getWhitelistBotMarkup(m.Chat.ID, bot.ID))
+	if err != nil {
+		LogE.Printf("couldn't post blocked bot notice in chat %d: %s", m.Chat.ID, err)
+		return
+	}
+	if ttl, _ := strconv.Atoi(settings["noticeTTL"]); ttl > 0 {
+		deleteMessageLater(sent, time.Duration(ttl)*time.Second)
+	}
+}
+
+// whitelists a blocked bot when one of the chat's beru admins presses the button
+func onWhitelistBotCallback(c *tb.Callback) {
+	parts := strings.SplitN(c.Data, ":", 2)
+	if len(parts) != 2 {
+		B.Respond(c, &tb.CallbackResponse{})
+		return
+	}
+	chatID, _ := strconv.ParseInt(parts[0], 10, 64)
+	botID, _ := strconv.Atoi(parts[1])
+	if !isActiveAdmin(c.Sender.ID, chatID) {
+		B.Respond(c, &tb.CallbackResponse{Text: "Only admins of this chat can whitelist bots"})
+		return
+	}
+	if err := whitelistBot(chatID, botID); err != nil {
+		LogE.Print(err)
+		B.Respond(c, &tb.CallbackResponse{Text: ErrorResponse})
+		return
+	}
+	audit(AuditEntry{ChatID: chatID, Action: AuditBotWhitelisted, Target: botLabel(botID), TargetID: botID}.by(c.Sender))
+	B.EditReplyMarkup(c.Message, nil)
+	B.Respond(c, &tb.CallbackResponse{Text: botLabel(botID) + " has been whitelisted and can be added again"})
+}
+
+// lists the bots that were removed from the chat, each with a button to whitelist it
+func viewBlockedBots(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	bots, err := getBlockedBots(int64(chatID))
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return err
+	}
+	if len(bots) == 0 {
+		B.Send(sender, "No bots have been blocked from "+chatTitle)
+		return
+	}
+	for _, b := range bots {
+		B.Send(sender, b.String(), getWhitelistBotMarkup(int64(chatID), b.ID))
+	}
+	return
+}
+
+// receives the action, the notice (or None) and how many seconds the notice stays up
+func setBlockedBotAction(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	action, notice, ttlText := ms[0].Text, ms[1].Text, ms[2].Text
+	if action != BotActionBan && action != BotActionKick && action != BotActionBanAndAdder {
+		B.Send(sender, fmt.Sprintf("%s isn't an action, pick %s, %s or %s", action, BotActionBan, BotActionKick, BotActionBanAndAdder))
+		return
+	}
+	if notice == NoNotice {
+		notice = ""
+	}
+	if _, err := renderTemplate("blockedBot", notice, BlockedBotContext{}); err != nil {
+		B.Send(sender, fmt.Sprintf("The notice isn't a valid template: %s", errors.Cause(err)))
+		return nil
+	}
+	ttl, err := strconv.Atoi(ttlText)
+	if err != nil || ttl < 0 {
+		B.Send(sender, fmt.Sprintf("\"%s\" isn't a number of seconds", ttlText))
+		return nil
+	}
+	key := fmt.Sprintf("chat:%d:blockedBot", chatID)
+	err = R.HMSet(key, map[string]interface{}{
+		"action":    action,
+		"notice":    notice,
+		"noticeTTL": ttl,
+	}).Err()
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't save blocked bot settings for chat %d", chatID)
+	}
+	msg := fmt.Sprintf("Bots that aren't whitelisted in %s will be handled with: %s", chatTitle, action)
+	switch {
+	case notice == "":
+		msg += "\nNo notice will be posted"
+	case ttl > 0:
+		msg += fmt.Sprintf("\nThe notice will be deleted after %d seconds", ttl)
+	}
+	B.Send(sender, msg)
+	return
+}
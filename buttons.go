@@ -24,6 +24,10 @@ var FunctionGroups = []FunctionButton{
 		"Manage Chats",
 		listChatFunctions,
 	},
+	{
+		"Manage Schedules",
+		listScheduleFunctions,
+	},
 	{
 		"Manage Admins",
 		listAdminFunctions,
@@ -51,6 +55,13 @@ func listChatFunctions(m *tb.Message) {
 	})
 }
 
+func listScheduleFunctions(m *tb.Message) {
+	B.Send(m.Sender, "Here are the scheduled message commands", &tb.ReplyMarkup{
+		ReplyKeyboard:       getReplyKeyboardForCommands(ScheduleFunctions),
+		ResizeReplyKeyboard: true,
+	})
+}
+
 func listFunctionGroups(m *tb.Message) {
 	chatID, _, _ := getUsersActiveChat(m.Sender.ID)
 	if chatID == 0 {
@@ -95,6 +106,10 @@ var CommandFunctions = []FunctionButton{
 		"Add Command",
 		BuiltinCommandRegistry["/addcommand"],
 	},
+	{
+		"Add Command Pool",
+		BuiltinCommandRegistry["/addcommandpool"],
+	},
 	{
 		"Remove Command",
 		BuiltinCommandRegistry["/removecommand"],
@@ -103,6 +118,26 @@ var CommandFunctions = []FunctionButton{
 		"View Commands",
 		BuiltinCommandRegistry["/viewcommands"],
 	},
+	{
+		"Export Commands",
+		BuiltinCommandRegistry["/exportcommands"],
+	},
+	{
+		"Import Commands",
+		BuiltinCommandRegistry["/importcommands"],
+	},
+	{
+		"Add Auto-Responder",
+		BuiltinCommandRegistry["/addautoresponder"],
+	},
+	{
+		"Remove Auto-Responder",
+		BuiltinCommandRegistry["/removeautoresponder"],
+	},
+	{
+		"View Auto-Responders",
+		BuiltinCommandRegistry["/viewautoresponders"],
+	},
 }
 
 var ChatFunctions = []FunctionButton{
@@ -118,10 +153,130 @@ var ChatFunctions = []FunctionButton{
 		"Switch Chat",
 		BuiltinCommandRegistry["/switchchat"],
 	},
+	{
+		"Clone Chat",
+		BuiltinCommandRegistry["/clonechat"],
+	},
 	{
 		"Set Welcome",
 		BuiltinCommandRegistry["/setwelcome"],
 	},
+	{
+		"Set Media Policy",
+		BuiltinCommandRegistry["/setmediapolicy"],
+	},
+	{
+		"Set Captcha",
+		BuiltinCommandRegistry["/setcaptcha"],
+	},
+	{
+		"Set Flood Protection",
+		BuiltinCommandRegistry["/setflood"],
+	},
+	{
+		"Set Raid Protection",
+		BuiltinCommandRegistry["/setraid"],
+	},
+	{
+		"Set Night Mode",
+		BuiltinCommandRegistry["/setnightmode"],
+	},
+	{
+		"Set Warnings",
+		BuiltinCommandRegistry["/setwarnings"],
+	},
+	{
+		"Add Filters",
+		BuiltinCommandRegistry["/addfilters"],
+	},
+	{
+		"Remove Filter",
+		BuiltinCommandRegistry["/removefilter"],
+	},
+	{
+		"View Filters",
+		BuiltinCommandRegistry["/viewfilters"],
+	},
+	{
+		"Add Name Filters",
+		BuiltinCommandRegistry["/addnamefilters"],
+	},
+	{
+		"Remove Name Filter",
+		BuiltinCommandRegistry["/removenamefilter"],
+	},
+	{
+		"View Name Filters",
+		BuiltinCommandRegistry["/viewnamefilters"],
+	},
+	{
+		"Set Impersonation Protection",
+		BuiltinCommandRegistry["/setimpersonation"],
+	},
+	{
+		"Set Audit Log Channel",
+		BuiltinCommandRegistry["/setauditlog"],
+	},
+	{
+		"View Audit Log",
+		BuiltinCommandRegistry["/viewauditlog"],
+	},
+	{
+		"Add Ban List",
+		BuiltinCommandRegistry["/addbanlist"],
+	},
+	{
+		"Toggle Ban List",
+		BuiltinCommandRegistry["/togglebanlist"],
+	},
+	{
+		"View Ban Lists",
+		BuiltinCommandRegistry["/viewbanlists"],
+	},
+	{
+		"Export Ban List",
+		BuiltinCommandRegistry["/exportbanlist"],
+	},
+	{
+		"Import Ban List",
+		BuiltinCommandRegistry["/importbanlist"],
+	},
+	{
+		"Toggle Native Restriction",
+		BuiltinCommandRegistry["/togglenativerestriction"],
+	},
+	{
+		"Allow Domains",
+		BuiltinCommandRegistry["/allowdomains"],
+	},
+	{
+		"Deny Domains",
+		BuiltinCommandRegistry["/denydomains"],
+	},
+	{
+		"Remove Domain",
+		BuiltinCommandRegistry["/removedomain"],
+	},
+	{
+		"View Domains",
+		BuiltinCommandRegistry["/viewdomains"],
+	},
+	{
+		"Toggle Address Guard",
+		BuiltinCommandRegistry["/toggleaddressguard"],
+	},
+	{
+		"Allow Addresses",
+		BuiltinCommandRegistry["/allowaddresses"],
+	},
+	{
+		"Remove Address",
+		BuiltinCommandRegistry["/removeaddress"],
+	},
+	{
+		"View Addresses",
+		BuiltinCommandRegistry["/viewaddresses"],
+	},
 	{
 		"Add Bot to Whitelist",
 		BuiltinCommandRegistry["/addwhitelistedbot"],
@@ -130,4 +285,31 @@ var ChatFunctions = []FunctionButton{
 		"Remove Bot from Whitelist",
 		BuiltinCommandRegistry["/removewhitelistedbot"],
 	},
+	{
+		"View Blocked Bots",
+		BuiltinCommandRegistry["/viewblockedbots"],
+	},
+	{
+		"Set Blocked Bot Action",
+		BuiltinCommandRegistry["/setblockedbotaction"],
+	},
+}
+
+var ScheduleFunctions = []FunctionButton{
+	{
+		"Add Schedule",
+		BuiltinCommandRegistry["/addschedule"],
+	},
+	{
+		"View Schedules",
+		BuiltinCommandRegistry["/viewschedules"],
+	},
+	{
+		"Pause Schedule",
+		BuiltinCommandRegistry["/pauseschedule"],
+	},
+	{
+		"Remove Schedule",
+		BuiltinCommandRegistry["/removeschedule"],
+	},
 }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// the kinds of challenge newcomers can be asked to solve
+const (
+	CaptchaOff        = "Off"
+	CaptchaButton     = "Button"
+	CaptchaArithmetic = "Arithmetic"
+	CaptchaEmoji      = "Emoji"
+)
+
+var CaptchaModeButtons = [][]string{{CaptchaOff, CaptchaButton}, {CaptchaArithmetic, CaptchaEmoji}}
+
+// how long newcomers get when a chat hasn't set a timeout
+const defaultCaptchaTimeout = 120
+
+// how long past the timeout the mute and the saved challenge last, so the
+// timeout job gets to kick them first but nothing outlives it if it never runs
+const captchaGrace = 2 * schedulerTick
+
+// wrong answers allowed before the newcomer is kicked
+const maxCaptchaAttempts = 3
+
+// inline button for answering a challenge, its data is "userID:answer"
+var captchaButton = tb.InlineButton{Unique: "captcha"}
+
+// emojis for the pick-the-emoji challenge and the names they're asked for by
+var captchaEmojis = []struct{ Emoji, Name string }{
+	{"🐶", "dog"}, {"🐱", "cat"}, {"🍎", "apple"}, {"🚗", "car"}, {"🏠", "house"},
+	{"🌙", "moon"}, {"⚽", "ball"}, {"🎸", "guitar"}, {"🌵", "cactus"}, {"🐟", "fish"},
+}
+
+// a challenge waiting for a newcomer to answer
+type Captcha struct {
+	ChatID    int64
+	UserID    int
+	Answer    string
+	Attempts  int
+	MessageID int
+	// the join notification, deleted along with the challenge if they fail
+	JoinMessageID int
+}
+
+func captchaKey(chatID int64, userID int) string {
+	return fmt.Sprintf("chat:%d:captcha:%d", chatID, userID)
+}
+
+// the chat's captcha mode and how many seconds newcomers have to answer
+func getCaptchaSettings(chatID int64) (string, int) {
+	settings, _ := R.HGetAll(fmt.Sprintf("chat:%d:captchaSettings", chatID)).Result()
+	mode := settings["mode"]
+	if mode == "" {
+		mode = CaptchaOff
+	}
+	timeout, err := strconv.Atoi(settings["timeout"])
+	if err != nil || timeout <= 0 {
+		timeout = defaultCaptchaTimeout
+	}
+	return mode, timeout
+}
+
+// builds the question, the buttons offered and the right answer
+func newChallenge(mode string, userID int) (string, [][]tb.InlineButton, string) {
+	options := []string{}
+	answer, question := "", ""
+	switch mode {
+	case CaptchaArithmetic:
+		a, b := rand.Intn(9)+1, rand.Intn(9)+1
+		question = fmt.Sprintf("what is %d + %d?", a, b)
+		answer = strconv.Itoa(a + b)
+		options = append(options, answer)
+		for _, offset := range rand.Perm(8)[:3] {
+			// wrong answers are close to the right one but never equal
+			wrong := a + b + offset - 4
+			if wrong <= a+b {
+				wrong--
+			}
+			options = append(options, strconv.Itoa(wrong))
+		}
+	case CaptchaEmoji:
+		picks := rand.Perm(len(captchaEmojis))[:4]
+		target := captchaEmojis[picks[0]]
+		question = fmt.Sprintf("press the %s.", target.Name)
+		answer = target.Emoji
+		for _, i := range picks {
+			options = append(options, captchaEmojis[i].Emoji)
+		}
+	default:
+		question = "press the button below to show you're human."
+		answer = "human"
+		options = append(options, answer)
+	}
+	rand.Shuffle(len(options), func(i, j int) { options[i], options[j] = options[j], options[i] })
+	row := []tb.InlineButton{}
+	for _, o := range options {
+		button := captchaButton
+		button.Text = o
+		if o == "human" {
+			button.Text = "I'm not a robot"
+		}
+		button.Data = fmt.Sprintf("%d:%s", userID, o)
+		row = append(row, button)
+	}
+	return question, [][]tb.InlineButton{row}, answer
+}
+
+// mutes the newcomer and posts a challenge only they can answer,
+// returns false if the chat doesn't use a captcha or it couldn't be posted
+func startCaptcha(m *tb.Message, u *tb.User) bool {
+	mode, timeout := getCaptchaSettings(m.Chat.ID)
+	if mode == CaptchaOff && inLockdown(m.Chat.ID) {
+		mode = CaptchaArithmetic
+	}
+	if mode == CaptchaOff {
+		return false
+	}
+	expiry := time.Duration(timeout)*time.Second + captchaGrace
+	if err := muteMember(m.Chat, u, time.Now().Add(expiry).Unix()); err != nil {
+		LogW.Printf("couldn't mute user %d in chat %d for a captcha: %s", u.ID, m.Chat.ID, err)
+		return false
+	}
+	question, keyboard, answer := newChallenge(mode, u.ID)
+	text := fmt.Sprintf("Welcome %s, to be able to chat %s You have %d seconds.", displayName(u), question, timeout)
+	sent, err := B.Send(m.Chat, text, &tb.ReplyMarkup{InlineKeyboard: keyboard})
+	if err != nil {
+		LogE.Printf("couldn't post captcha in chat %d: %s", m.Chat.ID, err)
+		unmuteMember(m.Chat.ID, u.ID)
+		return false
+	}
+	c := Captcha{ChatID: m.Chat.ID, UserID: u.ID, Answer: answer, MessageID: sent.ID, JoinMessageID: m.ID}
+	if err := R.Set(captchaKey(m.Chat.ID, u.ID), EncodeCaptcha(&c), expiry).Err(); err != nil {
+		LogE.Printf("couldn't save captcha for user %d in chat %d: %s", u.ID, m.Chat.ID, err)
+	}
+	err = queueJob(Job{Type: JCaptchaTimeout, ChatID: m.Chat.ID, UserID: u.ID}, time.Now().Add(time.Duration(timeout)*time.Second))
+	if err != nil {
+		LogE.Printf("captcha for user %d in chat %d won't time out: %s", u.ID, m.Chat.ID, err)
+	}
+	return true
+}
+
+func getCaptcha(chatID int64, userID int) (Captcha, error) {
+	data, err := R.Get(captchaKey(chatID, userID)).Bytes()
+	if err != nil {
+		return Captcha{}, errors.Wrapf(err, "no captcha for user %d in chat %d", userID, chatID)
+	}
+	return DecodeCaptcha(data), nil
+}
+
+// kicks the newcomer and removes the challenge and their join notification
+func failCaptcha(c Captcha) {
+	chat := &tb.Chat{ID: c.ChatID}
+	R.Del(captchaKey(c.ChatID, c.UserID))
+	if err := kickMember(chat, &tb.User{ID: c.UserID}); err != nil {
+		LogE.Printf("couldn't kick user %d from chat %d after a failed captcha: %s", c.UserID, c.ChatID, err)
+	}
+	B.Delete(&tb.Message{ID: c.MessageID, Chat: chat})
+	B.Delete(&tb.Message{ID: c.JoinMessageID, Chat: chat})
+	LogI.Printf("user %d failed the captcha in chat %d", c.UserID, c.ChatID)
+	audit(AuditEntry{ChatID: c.ChatID, Action: AuditCaptchaFailed, Reason: "removed from the chat"}.against(knownUser(c.UserID)))
+}
+
+// lets the newcomer talk, keeping them restricted from media if the chat
+// restricts newcomers natively and their restriction time isn't up
+func passCaptcha(c Captcha) {
+	chat := &tb.Chat{ID: c.ChatID}
+	R.Del(captchaKey(c.ChatID, c.UserID))
+	B.Delete(&tb.Message{ID: c.MessageID, Chat: chat})
+	ttl := R.TTL(fmt.Sprintf("chat:%d:userRestricted:%d", c.ChatID, c.UserID)).Val()
+	if ttl > 0 && (nativeRestrictionEnabled(c.ChatID) || inLockdown(c.ChatID)) && restrictNewUser(chat, &tb.User{ID: c.UserID}, ttl) {
+		return
+	}
+	unmuteMember(c.ChatID, c.UserID)
+}
+
+func captchaTimeout(j Job) error {
+	c, err := getCaptcha(j.ChatID, j.UserID)
+	if err != nil {
+		// they already answered
+		return nil
+	}
+	failCaptcha(c)
+	return nil
+}
+
+func onCaptchaCallback(cb *tb.Callback) {
+	parts := strings.SplitN(cb.Data, ":", 2)
+	if len(parts) != 2 || cb.Message == nil {
+		B.Respond(cb, &tb.CallbackResponse{})
+		return
+	}
+	userID, _ := strconv.Atoi(parts[0])
+	if cb.Sender.ID != userID {
+		B.Respond(cb, &tb.CallbackResponse{Text: "This challenge isn't for you"})
+		return
+	}
+	c, err := getCaptcha(cb.Message.Chat.ID, userID)
+	if err != nil {
+		B.Respond(cb, &tb.CallbackResponse{Text: "This challenge has expired"})
+		return
+	}
+	if parts[1] == c.Answer {
+		passCaptcha(c)
+		B.Respond(cb, &tb.CallbackResponse{Text: "Thanks, you can chat now"})
+		return
+	}
+	c.Attempts++
+	if c.Attempts >= maxCaptchaAttempts {
+		B.Respond(cb, &tb.CallbackResponse{Text: "That's wrong too many times"})
+		failCaptcha(c)
+		return
+	}
+	// the challenge keeps the time it had left
+	if ttl := R.TTL(captchaKey(c.ChatID, c.UserID)).Val(); ttl > 0 {
+		R.Set(captchaKey(c.ChatID, c.UserID), EncodeCaptcha(&c), ttl)
+	}
+	left := maxCaptchaAttempts - c.Attempts
+	B.Respond(cb, &tb.CallbackResponse{Text: fmt.Sprintf("That's not right, %d tries left", left)})
+}
+
+// receives the captcha mode and the number of seconds to answer
+func setCaptcha(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	mode, timeoutText := ms[0].Text, ms[1].Text
+	switch mode {
+	case CaptchaOff, CaptchaButton, CaptchaArithmetic, CaptchaEmoji:
+	default:
+		B.Send(sender, fmt.Sprintf("%s isn't a kind of captcha", mode))
+		return
+	}
+	timeout, err := strconv.Atoi(timeoutText)
+	if err != nil || timeout < 30 {
+		B.Send(sender, "The time to answer needs to be a number of seconds, at least 30")
+		return nil
+	}
+	key := fmt.Sprintf("chat:%d:captchaSettings", chatID)
+	err = R.HMSet(key, map[string]interface{}{"mode": mode, "timeout": timeout}).Err()
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't save captcha settings for chat %d", chatID)
+	}
+	if mode == CaptchaOff {
+		B.Send(sender, "New users in "+chatTitle+" won't have to solve a captcha")
+	} else {
+		B.Send(sender, fmt.Sprintf("New users in %s will be muted until they solve a %s captcha, "+
+			"if they don't within %d seconds they'll be kicked. Make sure I'm an admin that can ban users "+
+			"and delete messages", chatTitle, strings.ToLower(mode), timeout))
+	}
+	return
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// a group of chat settings that can be copied between chats, the
+// attributes are the last part of the chat:%chatID:attribute keys
+type CloneSetting struct {
+	Label      string
+	Attributes []string
+}
+
+var CloneSettings = []CloneSetting{
+	{"Commands", []string{"commands", "commandParseModes", "commandButtons", "commandPools"}},
+	{"Auto-Responders", []string{"autoResponders"}},
+	{"Welcome Message", []string{"usersJoinedMessage", "usersJoinedParseMode", "usersJoinedLimit"}},
+	{"Join Notification Deletion", []string{"deleteJoinNotification"}},
+	{"Captcha", []string{"captchaSettings"}},
+	{"Flood Protection", []string{"flood"}},
+	{"Raid Protection", []string{"raid"}},
+	{"Night Mode", []string{"nightMode"}},
+	{"Warning Thresholds", []string{"warnSettings"}},
+	{"Domain Lists", []string{"domainAllowlist", "domainDenylist"}},
+	{"Address Guard", []string{"addressGuard", "addressAllowlist"}},
+	{"Filters", []string{"filters"}},
+	{"Name Filters", []string{"nameFilters"}},
+	{"Impersonation Protection", []string{"impersonation"}},
+	{"Audit Log Channel", []string{"auditChannel"}},
+	{"Bot Whitelist", []string{"botWhitelist", "blockedBot"}},
+	{"Price Command", []string{"price"}},
+	{"Media Restriction", []string{"userRestrictionTime", "mediaPolicy", "nativeRestriction"}},
+}
+
+// how many times a copy is tried when a source key keeps changing under it
+const cloneAttempts = 3
+
+func cloneSettingLabels() []string {
+	labels := []string{}
+	for _, s := range CloneSettings {
+		labels = append(labels, s.Label)
+	}
+	return labels
+}
+
+// copies the keys behind the chosen settings from one chat to another in a
+// single transaction, settings the source doesn't have are cleared in the target.
+// the transaction fails with redis.TxFailedErr if a source key changes mid copy
+func copyChatSettings(sourceID int, targetID int, settings []CloneSetting) error {
+	sourceKeys := []string{}
+	targetKeys := []string{}
+	for _, s := range settings {
+		for _, a := range s.Attributes {
+			sourceKeys = append(sourceKeys, fmt.Sprintf("chat:%d:%s", sourceID, a))
+			targetKeys = append(targetKeys, fmt.Sprintf("chat:%d:%s", targetID, a))
+		}
+	}
+	return R.Watch(func(tx *redis.Tx) error {
+		dumps := make([]string, len(sourceKeys))
+		for i, k := range sourceKeys {
+			dump, err := tx.Dump(k).Result()
+			if err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "couldn't dump %s", k)
+			}
+			dumps[i] = dump
+		}
+		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, k := range targetKeys {
+				if dumps[i] == "" {
+					pipe.Del(k)
+				} else {
+					pipe.RestoreReplace(k, 0, dumps[i])
+				}
+			}
+			return nil
+		})
+		return err
+	}, sourceKeys...)
+}
+
+// receives the source chat ID, target chat ID and the ticked settings
+func cloneChat(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	if len(ms) < 3 {
+		B.Send(sender, "you need to pick a source chat, a target chat and the settings to copy")
+		return
+	}
+	sourceID, err := strconv.Atoi(ms[0].Text)
+	if err != nil {
+		B.Send(sender, "You need to pick the source chat from the keyboard")
+		return nil
+	}
+	targetID, err := strconv.Atoi(ms[1].Text)
+	if err != nil {
+		B.Send(sender, "You need to pick the target chat from the keyboard")
+		return nil
+	}
+	// both chats have to be managed by the user
+	chatsKey := fmt.Sprintf("user:%d:chats", sender.ID)
+	for _, id := range []int{sourceID, targetID} {
+		if ok, _ := R.SIsMember(chatsKey, id).Result(); !ok {
+			B.Send(sender, "You can only copy settings between chats you manage")
+			return nil
+		}
+	}
+	if sourceID == targetID {
+		B.Send(sender, "The source and target chats need to be different")
+		return nil
+	}
+	settings := []CloneSetting{}
+	for _, label := range splitChecklist(ms[2].Text) {
+		for _, s := range CloneSettings {
+			if s.Label == label {
+				settings = append(settings, s)
+			}
+		}
+	}
+	if len(settings) == 0 {
+		B.Send(sender, "No settings were picked, nothing was copied")
+		return
+	}
+	for attempt := 0; attempt < cloneAttempts; attempt++ {
+		if err = copyChatSettings(sourceID, targetID, settings); err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		B.Send(sender, "The settings couldn't be copied, nothing was changed in the target chat")
+		return errors.Wrapf(err, "couldn't clone chat %d into %d", sourceID, targetID)
+	}
+	sourceTitle, _ := getChatTitle(sourceID)
+	targetTitle, _ := getChatTitle(targetID)
+	lines := []string{fmt.Sprintf("Copied from %s to %s:", sourceTitle, targetTitle)}
+	labels := []string{}
+	for _, s := range settings {
+		lines = append(lines, "- "+s.Label)
+		labels = append(labels, s.Label)
+	}
+	audit(AuditEntry{ChatID: int64(targetID), Action: AuditSettingsCopied,
+		Reason: fmt.Sprintf("copied %s from %s", strings.Join(labels, ", "), sourceTitle)}.by(sender))
+	LogI.Printf("user %d cloned %s from chat %d to %d", sender.ID, ms[2].Text, sourceID, targetID)
+	B.Send(sender, strings.Join(lines, "\n"))
+	return
+}
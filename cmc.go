@@ -4,6 +4,8 @@ import (
 	rq "github.com/levigross/grequests"
 	jsp "github.com/buger/jsonparser"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 type Token struct {
@@ -41,3 +43,18 @@ func getTokenPrice(id int64, conversion string) (float64, float64, float64, floa
 	pct_converted, _ := jsp.GetFloat(data, "data", "quotes", conversion, "percent_change_24h")
 	return price, converted, pct_price, pct_converted
 }
+
+// fills in the tags a user can use in the price message format
+func formatPriceMessage(msgFormat string, slug string, token Token, price float64,
+	converted float64, pct_price float64, pct_conversion float64) string {
+	replacer := strings.NewReplacer(
+		"{{price}}", strconv.FormatFloat(price, 'f', 5, 64),
+		"{{ticker}}", token.Symbol,
+		"{{name}}", token.Name,
+		"{{slug}}", slug,
+		"{{conversion}}", strconv.FormatFloat(converted, 'f', 8, 64),
+		"{{price_pct_change}}", fmt.Sprintf("%+.1f%%", pct_price),
+		"{{conversion_pct_change}}", fmt.Sprintf("%+.1f%%", pct_conversion),
+	)
+	return replacer.Replace(msgFormat)
+}
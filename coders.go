@@ -108,3 +108,278 @@ func DecodeUser(data []byte) *tb.User{
 	}
 	return u
 }
+
+func EncodeAutoResponder(a *AutoResponder) []byte {
+	var by bytes.Buffer
+	enc := gob.NewEncoder(&by)
+	if err := enc.Encode(a); err != nil {
+		LogE.Printf("could not gob encode %s due to %s",
+			reflect.TypeOf(a), err)
+		panic(err)
+	}
+	data := by.Bytes()
+	return data
+}
+
+func DecodeAutoResponder(data []byte) AutoResponder {
+	var by bytes.Buffer
+	by.Write(data)
+	dec := gob.NewDecoder(&by)
+	a := AutoResponder{}
+	if err := dec.Decode(&a); err != nil {
+		LogE.Printf(
+			"Unable to decode data into the new %s struct due to %s",
+			reflect.TypeOf(a), err)
+	}
+	return a
+}
+
+func EncodeURLButtons(layout [][]URLButton) []byte {
+	var by bytes.Buffer
+	enc := gob.NewEncoder(&by)
+	if err := enc.Encode(layout); err != nil {
+		LogE.Printf("could not gob encode %s due to %s",
+			reflect.TypeOf(layout), err)
+		panic(err)
+	}
+	data := by.Bytes()
+	return data
+}
+
+func DecodeURLButtons(data []byte) [][]URLButton {
+	var by bytes.Buffer
+	by.Write(data)
+	dec := gob.NewDecoder(&by)
+	layout := [][]URLButton{}
+	if err := dec.Decode(&layout); err != nil {
+		LogE.Printf(
+			"Unable to decode data into the new %s struct due to %s",
+			reflect.TypeOf(layout), err)
+	}
+	return layout
+}
+
+func EncodeSchedule(s *Schedule) []byte {
+	var by bytes.Buffer
+	enc := gob.NewEncoder(&by)
+	if err := enc.Encode(s); err != nil {
+		LogE.Printf("could not gob encode %s due to %s",
+			reflect.TypeOf(s), err)
+		panic(err)
+	}
+	data := by.Bytes()
+	return data
+}
+
+func DecodeSchedule(data []byte) Schedule {
+	var by bytes.Buffer
+	by.Write(data)
+	dec := gob.NewDecoder(&by)
+	s := Schedule{}
+	if err := dec.Decode(&s); err != nil {
+		LogE.Printf(
+			"Unable to decode data into the new %s struct due to %s",
+			reflect.TypeOf(s), err)
+	}
+	return s
+}
+
+func EncodeResponsePool(p *ResponsePool) []byte {
+	var by bytes.Buffer
+	enc := gob.NewEncoder(&by)
+	if err := enc.Encode(p); err != nil {
+		LogE.Printf("could not gob encode %s due to %s",
+			reflect.TypeOf(p), err)
+		panic(err)
+	}
+	data := by.Bytes()
+	return data
+}
+
+func DecodeResponsePool(data []byte) ResponsePool {
+	var by bytes.Buffer
+	by.Write(data)
+	dec := gob.NewDecoder(&by)
+	p := ResponsePool{}
+	if err := dec.Decode(&p); err != nil {
+		LogE.Printf(
+			"Unable to decode data into the new %s struct due to %s",
+			reflect.TypeOf(p), err)
+	}
+	return p
+}
+
+func EncodeJob(j *Job) []byte {
+	var by bytes.Buffer
+	enc := gob.NewEncoder(&by)
+	if err := enc.Encode(j); err != nil {
+		LogE.Printf("could not gob encode %s due to %s",
+			reflect.TypeOf(j), err)
+		panic(err)
+	}
+	data := by.Bytes()
+	return data
+}
+
+func DecodeJob(data []byte) Job {
+	var by bytes.Buffer
+	by.Write(data)
+	dec := gob.NewDecoder(&by)
+	j := Job{}
+	if err := dec.Decode(&j); err != nil {
+		LogE.Printf(
+			"Unable to decode data into the new %s struct due to %s",
+			reflect.TypeOf(j), err)
+	}
+	return j
+}
+
+func EncodeBlockedBot(b *BlockedBot) []byte {
+	var by bytes.Buffer
+	enc := gob.NewEncoder(&by)
+	if err := enc.Encode(b); err != nil {
+		LogE.Printf("could not gob encode %s due to %s",
+			reflect.TypeOf(b), err)
+		panic(err)
+	}
+	data := by.Bytes()
+	return data
+}
+
+func DecodeBlockedBot(data []byte) BlockedBot {
+	var by bytes.Buffer
+	by.Write(data)
+	dec := gob.NewDecoder(&by)
+	b := BlockedBot{}
+	if err := dec.Decode(&b); err != nil {
+		LogE.Printf(
+			"Unable to decode data into the new %s struct due to %s",
+			reflect.TypeOf(b), err)
+	}
+	return b
+}
+
+func EncodeCaptcha(c *Captcha) []byte {
+	var by bytes.Buffer
+	enc := gob.NewEncoder(&by)
+	if err := enc.Encode(c); err != nil {
+		LogE.Printf("could not gob encode %s due to %s",
+			reflect.TypeOf(c), err)
+		panic(err)
+	}
+	data := by.Bytes()
+	return data
+}
+
+func DecodeCaptcha(data []byte) Captcha {
+	var by bytes.Buffer
+	by.Write(data)
+	dec := gob.NewDecoder(&by)
+	c := Captcha{}
+	if err := dec.Decode(&c); err != nil {
+		LogE.Printf(
+			"Unable to decode data into the new %s struct due to %s",
+			reflect.TypeOf(c), err)
+	}
+	return c
+}
+
+func EncodeWarning(w *Warning) []byte {
+	var by bytes.Buffer
+	enc := gob.NewEncoder(&by)
+	if err := enc.Encode(w); err != nil {
+		LogE.Printf("could not gob encode %s due to %s",
+			reflect.TypeOf(w), err)
+		panic(err)
+	}
+	data := by.Bytes()
+	return data
+}
+
+func DecodeWarning(data []byte) Warning {
+	var by bytes.Buffer
+	by.Write(data)
+	dec := gob.NewDecoder(&by)
+	w := Warning{}
+	if err := dec.Decode(&w); err != nil {
+		LogE.Printf(
+			"Unable to decode data into the new %s struct due to %s",
+			reflect.TypeOf(w), err)
+	}
+	return w
+}
+
+func EncodeFilterRule(f *FilterRule) []byte {
+	var by bytes.Buffer
+	enc := gob.NewEncoder(&by)
+	if err := enc.Encode(f); err != nil {
+		LogE.Printf("could not gob encode %s due to %s",
+			reflect.TypeOf(f), err)
+		panic(err)
+	}
+	data := by.Bytes()
+	return data
+}
+
+func DecodeFilterRule(data []byte) FilterRule {
+	var by bytes.Buffer
+	by.Write(data)
+	dec := gob.NewDecoder(&by)
+	f := FilterRule{}
+	if err := dec.Decode(&f); err != nil {
+		LogE.Printf(
+			"Unable to decode data into the new %s struct due to %s",
+			reflect.TypeOf(f), err)
+	}
+	return f
+}
+
+func EncodeRights(r *tb.Rights) []byte {
+	var by bytes.Buffer
+	enc := gob.NewEncoder(&by)
+	if err := enc.Encode(r); err != nil {
+		LogE.Printf("could not gob encode %s due to %s",
+			reflect.TypeOf(r), err)
+		panic(err)
+	}
+	data := by.Bytes()
+	return data
+}
+
+func DecodeRights(data []byte) tb.Rights {
+	var by bytes.Buffer
+	by.Write(data)
+	dec := gob.NewDecoder(&by)
+	r := tb.Rights{}
+	if err := dec.Decode(&r); err != nil {
+		LogE.Printf(
+			"Unable to decode data into the new %s struct due to %s",
+			reflect.TypeOf(r), err)
+	}
+	return r
+}
+
+func EncodeReport(r *Report) []byte {
+	var by bytes.Buffer
+	enc := gob.NewEncoder(&by)
+	if err := enc.Encode(r); err != nil {
+		LogE.Printf("could not gob encode %s due to %s",
+			reflect.TypeOf(r), err)
+		panic(err)
+	}
+	data := by.Bytes()
+	return data
+}
+
+func DecodeReport(data []byte) Report {
+	var by bytes.Buffer
+	by.Write(data)
+	dec := gob.NewDecoder(&by)
+	r := Report{}
+	if err := dec.Decode(&r); err != nil {
+		LogE.Printf(
+			"Unable to decode data into the new %s struct due to %s",
+			reflect.TypeOf(r), err)
+	}
+	return r
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
+	"text/template"
 
 	"github.com/go-redis/redis"
 	"github.com/pkg/errors"
@@ -31,6 +34,48 @@ const (
 	CAddWhitelistedBot     ConsumerType = "/addwhitelistedbot"
 	CSetPriceCommand       ConsumerType = "/setpricecommand"
 	CSetNewUserRestriction ConsumerType = "/setnewusermediarestriction"
+	CAddAutoResponder      ConsumerType = "/addautoresponder"
+	CRemoveAutoResponder   ConsumerType = "/removeautoresponder"
+	CViewAutoResponders    ConsumerType = "/viewautoresponders"
+	CExportCommands        ConsumerType = "/exportcommands"
+	CImportCommands        ConsumerType = "/importcommands"
+	CCloneChat             ConsumerType = "/clonechat"
+	CAddSchedule           ConsumerType = "/addschedule"
+	CViewSchedules         ConsumerType = "/viewschedules"
+	CToggleSchedule        ConsumerType = "/pauseschedule"
+	CRemoveSchedule        ConsumerType = "/removeschedule"
+	CAddCommandPool        ConsumerType = "/addcommandpool"
+	CSetMediaPolicy        ConsumerType = "/setmediapolicy"
+	CToggleNativeRestrict  ConsumerType = "/togglenativerestriction"
+	CAllowDomains          ConsumerType = "/allowdomains"
+	CDenyDomains           ConsumerType = "/denydomains"
+	CRemoveDomain          ConsumerType = "/removedomain"
+	CViewDomains           ConsumerType = "/viewdomains"
+	CToggleAddressGuard    ConsumerType = "/toggleaddressguard"
+	CAllowAddresses        ConsumerType = "/allowaddresses"
+	CRemoveAddress         ConsumerType = "/removeaddress"
+	CViewAddresses         ConsumerType = "/viewaddresses"
+	CViewBlockedBots       ConsumerType = "/viewblockedbots"
+	CSetBlockedBotAction   ConsumerType = "/setblockedbotaction"
+	CSetCaptcha            ConsumerType = "/setcaptcha"
+	CSetFlood              ConsumerType = "/setflood"
+	CSetWarnings           ConsumerType = "/setwarnings"
+	CAddFilters            ConsumerType = "/addfilters"
+	CRemoveFilter          ConsumerType = "/removefilter"
+	CViewFilters           ConsumerType = "/viewfilters"
+	CAddNameFilters        ConsumerType = "/addnamefilters"
+	CRemoveNameFilter      ConsumerType = "/removenamefilter"
+	CViewNameFilters       ConsumerType = "/viewnamefilters"
+	CSetImpersonation      ConsumerType = "/setimpersonation"
+	CSetAuditLog           ConsumerType = "/setauditlog"
+	CViewAuditLog          ConsumerType = "/viewauditlog"
+	CSetRaid               ConsumerType = "/setraid"
+	CSetNightMode          ConsumerType = "/setnightmode"
+	CAddBanList            ConsumerType = "/addbanlist"
+	CToggleBanList         ConsumerType = "/togglebanlist"
+	CViewBanLists          ConsumerType = "/viewbanlists"
+	CExportBanList         ConsumerType = "/exportbanlist"
+	CImportBanList         ConsumerType = "/importbanlist"
 )
 
 type Consumer func([]*tb.Message) error
@@ -51,6 +96,48 @@ var ConsumerRegistry = map[ConsumerType]Consumer{
 	CAddWhitelistedBot:     addWhitelistedBot,
 	CSetPriceCommand:       setPriceCommand,
 	CSetNewUserRestriction: setNewUserMediaRestriction,
+	CAddAutoResponder:      addAutoResponder,
+	CRemoveAutoResponder:   removeAutoResponder,
+	CViewAutoResponders:    viewAutoResponders,
+	CExportCommands:        exportCommands,
+	CImportCommands:        importCommands,
+	CCloneChat:             cloneChat,
+	CAddSchedule:           addSchedule,
+	CViewSchedules:         viewSchedules,
+	CToggleSchedule:        toggleSchedule,
+	CRemoveSchedule:        removeSchedule,
+	CAddCommandPool:        addCommandPool,
+	CSetMediaPolicy:        setMediaPolicy,
+	CToggleNativeRestrict:  toggleNativeRestriction,
+	CAllowDomains:          allowDomains,
+	CDenyDomains:           denyDomains,
+	CRemoveDomain:          removeDomain,
+	CViewDomains:           viewDomains,
+	CToggleAddressGuard:    toggleAddressGuard,
+	CAllowAddresses:        allowAddresses,
+	CRemoveAddress:         removeAddress,
+	CViewAddresses:         viewAddresses,
+	CViewBlockedBots:       viewBlockedBots,
+	CSetBlockedBotAction:   setBlockedBotAction,
+	CSetCaptcha:            setCaptcha,
+	CSetFlood:              setFlood,
+	CSetWarnings:           setWarnings,
+	CAddFilters:            addFilters,
+	CRemoveFilter:          removeFilter,
+	CViewFilters:           viewFilters,
+	CAddNameFilters:        addNameFilters,
+	CRemoveNameFilter:      removeNameFilter,
+	CViewNameFilters:       viewNameFilters,
+	CSetImpersonation:      setImpersonation,
+	CSetAuditLog:           setAuditLog,
+	CViewAuditLog:          viewAuditLog,
+	CSetRaid:               setRaid,
+	CSetNightMode:          setNightMode,
+	CAddBanList:            addBanList,
+	CToggleBanList:         toggleBanList,
+	CViewBanLists:          viewBanLists,
+	CExportBanList:         exportBanList,
+	CImportBanList:         importBanList,
 }
 
 // consts for switching basic consumer behavior
@@ -98,6 +185,81 @@ func getInlineButtonForMessages(buttonTexts []string) [][]tb.InlineButton {
 	return keys
 }
 
+// a link shown under a custom command's response
+type URLButton struct {
+	Text string `json:"text"`
+	URL  string `json:"url"`
+}
+
+// parses a button layout written one row per line, with the buttons in a
+// row separated by | and each button written as "Text - URL"
+func parseURLButtons(text string) ([][]URLButton, error) {
+	layout := [][]URLButton{}
+	if strings.EqualFold(strings.TrimSpace(text), "none") {
+		return layout, nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		row := []URLButton{}
+		for _, b := range strings.Split(line, "|") {
+			split := strings.LastIndex(b, " - ")
+			if split < 0 {
+				return nil, errors.Errorf("\"%s\" needs to be written as Text - URL", strings.TrimSpace(b))
+			}
+			button := URLButton{
+				Text: strings.TrimSpace(b[:split]),
+				URL:  strings.TrimSpace(b[split+3:]),
+			}
+			if err := validateURLButton(button); err != nil {
+				return nil, err
+			}
+			row = append(row, button)
+		}
+		layout = append(layout, row)
+	}
+	return layout, nil
+}
+
+// buttons can only link to web pages and telegram and need some text
+func validateURLButton(b URLButton) error {
+	u, err := url.Parse(b.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "tg") {
+		return errors.Errorf("\"%s\" is not a valid link", b.URL)
+	}
+	if b.Text == "" {
+		return errors.Errorf("the button for %s needs some text", b.URL)
+	}
+	return nil
+}
+
+func getInlineKeyboardForURLButtons(layout [][]URLButton) [][]tb.InlineButton {
+	keys := [][]tb.InlineButton{}
+	for _, r := range layout {
+		row := []tb.InlineButton{}
+		for _, b := range r {
+			row = append(row, tb.InlineButton{Text: b.Text, URL: b.URL})
+		}
+		keys = append(keys, row)
+	}
+	return keys
+}
+
+// the keyboard of links to send with a custom command, nil if it has none
+func getCommandReplyMarkup(chatID int, name string) *tb.ReplyMarkup {
+	key := fmt.Sprintf("chat:%d:commandButtons", chatID)
+	data, err := R.HGet(key, name).Bytes()
+	if err != nil {
+		return nil
+	}
+	layout := DecodeURLButtons(data)
+	if len(layout) == 0 {
+		return nil
+	}
+	return &tb.ReplyMarkup{InlineKeyboard: getInlineKeyboardForURLButtons(layout)}
+}
+
 // utility used by the set, get, and remove admin consumers
 func accessAdmins(userID int, operation int, adminID ...string) (msg string, err error) {
 	chatID, chanTitle, err := getUsersActiveChat(userID)
@@ -122,6 +284,8 @@ func accessAdmins(userID int, operation int, adminID ...string) (msg string, err
 		userChatsKey := fmt.Sprintf("user:%s:chats", adminID[0])
 		err = R.SRem(userChatsKey, chatID).Err()
 		msg = fmt.Sprintf("admin removed: %s", adminID[0])
+		removed, _ := strconv.Atoi(adminID[0])
+		audit(AuditEntry{ChatID: int64(chatID), Action: AuditAdminRemoved}.by(knownUser(userID)).against(knownUser(removed)))
 	case cSet:
 		err = R.SAdd(activeKey, adminID[0]).Err()
 		userChatsKey := fmt.Sprintf("user:%s:chats", adminID[0])
@@ -133,6 +297,8 @@ func accessAdmins(userID int, operation int, adminID ...string) (msg string, err
 		}
 		msg = fmt.Sprintf("admin added: %s", adminID[0])
 		LogI.Printf("added admin: %d to chat %d", adminID[0], chatID)
+		added, _ := strconv.Atoi(adminID[0])
+		audit(AuditEntry{ChatID: int64(chatID), Action: AuditAdminAdded}.by(knownUser(userID)).against(knownUser(added)))
 	}
 	err = errors.Wrap(err, "")
 	return
@@ -175,19 +341,34 @@ func viewAdmins(ms []*tb.Message) (err error) {
 	return
 }
 
+// receives the command name, parse mode, response, buttons and the answer to the preview
 func addCommand(ms []*tb.Message) (err error) {
 	sender := ms[0].Sender
+	if len(ms) < 5 {
+		B.Send(sender, fmt.Sprint(
+			"you need to specify a command and response to add, such as /addCommand commandName;response text"))
+		return
+	}
 	commandName := ms[0].Text
 	if !strings.HasPrefix(commandName, "/") {
 		commandName = "/" + commandName
 	}
-	commandText := ms[1].Text
-	LogI.Printf("entered with msgs [%s %s]", commandName, commandText)
-	if len(ms) == 1 {
-		B.Send(sender, fmt.Sprint(
-			"you need to specify a command and response to add, such as /addCommand commandName;response text"))
+	parseMode, commandText := ms[1].Text, ms[2].Text
+	LogI.Printf("entered with msgs [%s %s %s]", commandName, parseMode, commandText)
+	if ms[4].Text != "Save" {
+		B.Send(sender, fmt.Sprintf("command %s was not saved", commandName))
+		return
+	}
+	if err = validateFormatting(commandText, parseMode); err != nil {
+		B.Send(sender, fmt.Sprintf("command %s was not saved, it isn't valid %s: %s", commandName, parseMode, err))
+		return nil
 	}
-	if err = registerStaticCommand(sender.ID, commandName, commandText); err != nil {
+	buttons, err := parseURLButtons(ms[3].Text)
+	if err != nil {
+		B.Send(sender, fmt.Sprintf("command %s was not saved, %s", commandName, err))
+		return nil
+	}
+	if err = registerStaticCommand(sender.ID, commandName, commandText, parseMode, buttons); err != nil {
 		msg := fmt.Sprintf("error while trying to add command %s", commandName)
 		B.Send(sender, msg)
 		return errors.Wrapf(err, msg)
@@ -224,16 +405,81 @@ func viewCommands(ms []*tb.Message) (err error) {
 	return
 }
 
-func registerStaticCommand(userID int, name string, text string) (err error) {
+func registerStaticCommand(userID int, name string, text string, parseMode string,
+	buttons [][]URLButton) (err error) {
 	chat, _, _ := getUsersActiveChat(userID)
 	key := fmt.Sprintf("chat:%d:commands", chat)
-	return R.HSet(key, name, text).Err()
+	modesKey := fmt.Sprintf("chat:%d:commandParseModes", chat)
+	buttonsKey := fmt.Sprintf("chat:%d:commandButtons", chat)
+	poolsKey := fmt.Sprintf("chat:%d:commandPools", chat)
+	_, err = R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(key, name, text)
+		pipe.HSet(modesKey, name, parseMode)
+		if len(buttons) > 0 {
+			pipe.HSet(buttonsKey, name, EncodeURLButtons(buttons))
+		} else {
+			pipe.HDel(buttonsKey, name)
+		}
+		pipe.HDel(poolsKey, name)
+		return nil
+	})
+	if err == nil {
+		audit(AuditEntry{ChatID: int64(chat), Action: AuditCommandChanged, Target: name, Reason: "set a response"}.by(knownUser(userID)))
+	}
+	return
+}
+
+// a command with a pool of responses keeps a description of the pool in
+// place of its response so it is still listed with the other commands
+func registerResponsePool(userID int, name string, pool ResponsePool, parseMode string) (err error) {
+	chat, _, _ := getUsersActiveChat(userID)
+	key := fmt.Sprintf("chat:%d:commands", chat)
+	modesKey := fmt.Sprintf("chat:%d:commandParseModes", chat)
+	buttonsKey := fmt.Sprintf("chat:%d:commandButtons", chat)
+	poolsKey := fmt.Sprintf("chat:%d:commandPools", chat)
+	_, err = R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(key, name, pool.String())
+		pipe.HSet(modesKey, name, parseMode)
+		pipe.HDel(buttonsKey, name)
+		pipe.HSet(poolsKey, name, EncodeResponsePool(&pool))
+		return nil
+	})
+	if err == nil {
+		audit(AuditEntry{ChatID: int64(chat), Action: AuditCommandChanged, Target: name, Reason: "set a response pool"}.by(knownUser(userID)))
+	}
+	return
+}
+
+// renders a stored response template, usually against the message that triggered it
+func renderTemplate(name string, text string, data interface{}) (string, error) {
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't parse template %s", name)
+	}
+	by := bytes.Buffer{}
+	if err := t.Execute(&by, data); err != nil {
+		return "", errors.Wrapf(err, "couldn't execute template %s", name)
+	}
+	return by.String(), nil
 }
 
 func unregisterStaticCommand(userID int, name string) (err error) {
 	chanID, _, _ := getUsersActiveChat(userID)
 	key := fmt.Sprintf("chat:%d:commands", chanID)
-	return R.HDel(key, name).Err()
+	modesKey := fmt.Sprintf("chat:%d:commandParseModes", chanID)
+	buttonsKey := fmt.Sprintf("chat:%d:commandButtons", chanID)
+	poolsKey := fmt.Sprintf("chat:%d:commandPools", chanID)
+	_, err = R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HDel(key, name)
+		pipe.HDel(modesKey, name)
+		pipe.HDel(buttonsKey, name)
+		pipe.HDel(poolsKey, name)
+		return nil
+	})
+	if err == nil {
+		audit(AuditEntry{ChatID: int64(chanID), Action: AuditCommandChanged, Target: name, Reason: "removed"}.by(knownUser(userID)))
+	}
+	return
 }
 
 func addChat(ms []*tb.Message) (err error) {
@@ -330,9 +576,18 @@ func removeChat(ms []*tb.Message) (err error) {
 	return
 }
 
+// receives the parse mode, message, the answer to the preview and the user count
 func setWelcome(ms []*tb.Message) (err error) {
 	chatID, _, _ := getUsersActiveChat(ms[0].Sender.ID)
-	message, count := ms[0].Text, ms[1].Text
+	if len(ms) < 4 || ms[2].Text != "Save" {
+		B.Send(ms[0].Sender, "The welcome message was not saved")
+		return
+	}
+	parseMode, message, count := ms[0].Text, ms[1].Text, ms[3].Text
+	if err = validateFormatting(message, parseMode); err != nil {
+		B.Send(ms[0].Sender, fmt.Sprintf("The welcome message was not saved, it isn't valid %s: %s", parseMode, err))
+		return nil
+	}
 	countInt, err := strconv.Atoi(count)
 	if err != nil {
 		B.Send(ms[0].Sender, fmt.Sprintf("User count needs to be a number, \"%s\" is not a number", count))
@@ -340,7 +595,9 @@ func setWelcome(ms []*tb.Message) (err error) {
 	}
 	limitKey := fmt.Sprintf("chat:%d:usersJoinedLimit", chatID)
 	messageKey := fmt.Sprintf("chat:%d:usersJoinedMessage", chatID)
+	parseModeKey := fmt.Sprintf("chat:%d:usersJoinedParseMode", chatID)
 	err = R.Set(messageKey, message, 0).Err()
+	err = R.Set(parseModeKey, parseMode, 0).Err()
 	err = R.Set(limitKey, countInt, 0).Err()
 	return
 }
@@ -366,35 +623,79 @@ func toggleJoinMessage(ms []*tb.Message) (err error) {
 	return
 }
 
+// receives a message forwarded from the bot, its ID or its username
 func addWhitelistedBot(ms []*tb.Message) (err error) {
-	chatID, _, err := getUsersActiveChat(ms[0].Sender.ID)
-	botName := ms[0].Text
-	if !strings.HasSuffix(strings.ToLower(botName), "bot") {
-		B.Send(ms[0].Sender, botName+" is not a bot")
+	sender := ms[0].Sender
+	chatID, _, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	botID, username, err := resolveBot(ms[0])
+	if err != nil {
+		B.Send(sender, err.Error())
+		return nil
+	}
+	if botID == 0 {
+		// usernames can be given up and taken by another bot, so only ones
+		// beru can tie to an ID are accepted
+		B.Send(sender, fmt.Sprintf("I haven't seen @%s before so I can't tell which bot it is, "+
+			"forward me a message from it or send its ID instead", username))
+		return nil
+	}
+	if !isKnownBot(botID) {
+		B.Send(sender, fmt.Sprintf("I can't tell whether %d is a bot, forward me a message from it instead", botID))
+		return nil
+	}
+	if err = whitelistBot(int64(chatID), botID); err != nil {
+		B.Send(sender, ErrorResponse)
 		return
 	}
-	err = R.SAdd(fmt.Sprintf("chat:%d:botWhitelist", chatID), botName).Err()
-	B.Send(ms[0].Sender, botName+" has been added to the whitelist")
-	B.Unban(&tb.Chat{ID: int64(chatID)}, &tb.User{Username: botName})
+	B.Send(sender, botLabel(botID)+" has been added to the whitelist")
 	return
 }
 
+// receives the label of a whitelisted or pending bot
 func removeWhitelistedBot(ms []*tb.Message) (err error) {
 	chatID, _, err := getUsersActiveChat(ms[0].Sender.ID)
 	botName := ms[0].Text
-	err = R.SRem(fmt.Sprintf("chat:%d:botWhitelist", chatID), botName, 0).Err()
+	botID, username, err := resolveBot(ms[0])
+	if err != nil {
+		B.Send(ms[0].Sender, err.Error())
+		return nil
+	}
+	_, err = R.TxPipelined(func(pipe redis.Pipeliner) error {
+		whitelistKey := fmt.Sprintf("chat:%d:botWhitelist", chatID)
+		if botID != 0 {
+			pipe.SRem(whitelistKey, botID)
+		}
+		if username != "" {
+			// whitelists from before IDs were stored kept the username as typed
+			pipe.SRem(whitelistKey, strings.TrimPrefix(botName, "@"))
+		}
+		return nil
+	})
 	B.Send(ms[0].Sender, botName+" has been removed from the whitelist")
 	return
 }
 
 func setPriceCommand(ms []*tb.Message) (err error) {
 	chatID, _, err := getUsersActiveChat(ms[0].Sender.ID)
-	slug, conversion, msgFormat := ms[0].Text, ms[1].Text, ms[2].Text
+	if len(ms) < 5 || ms[4].Text != "Save" {
+		B.Send(ms[0].Sender, "The /price command was not saved")
+		return
+	}
+	slug, conversion, parseMode, msgFormat := ms[0].Text, ms[1].Text, ms[2].Text, ms[3].Text
+	if err = validateFormatting(msgFormat, parseMode); err != nil {
+		B.Send(ms[0].Sender, fmt.Sprintf("The /price command was not saved, it isn't valid %s: %s", parseMode, err))
+		return nil
+	}
 
 	priceKey := fmt.Sprintf("chat:%d:price", chatID)
 	R.HSet(priceKey, "slug", slug)
 	R.HSet(priceKey, "conversion", conversion)
 	R.HSet(priceKey, "msgFormat", msgFormat)
+	R.HSet(priceKey, "parseMode", parseMode)
 
 	B.Send(ms[0].Sender, "/price command has been enabled and set to report  "+slug)
 	return
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// a custom command as it is written to an exported commands file
+type ExportedCommand struct {
+	Response  string        `json:"response"`
+	ParseMode string        `json:"parse_mode,omitempty"`
+	Buttons   [][]URLButton `json:"buttons,omitempty"`
+	Pool      *ResponsePool `json:"pool,omitempty"`
+}
+
+// the document sent by /exportcommands and accepted by /importcommands
+type CommandFile struct {
+	Commands map[string]ExportedCommand `json:"commands"`
+}
+
+// the changes an import would make to a chat's commands
+type CommandDiff struct {
+	Added   []string
+	Changed []string
+	Removed []string
+}
+
+func (d CommandDiff) String() string {
+	if len(d.Added)+len(d.Changed)+len(d.Removed) == 0 {
+		return "The file matches the current commands, there is nothing to import."
+	}
+	lines := []string{}
+	for _, section := range []struct {
+		label    string
+		commands []string
+	}{
+		{"Added", d.Added},
+		{"Changed", d.Changed},
+		{"Removed", d.Removed},
+	} {
+		if len(section.commands) > 0 {
+			lines = append(lines, fmt.Sprintf("%s (%d): %s",
+				section.label, len(section.commands), strings.Join(section.commands, ", ")))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reads every custom command stored for a chat
+func getCommandFile(chatID int) (CommandFile, error) {
+	key := fmt.Sprintf("chat:%d:commands", chatID)
+	commands, err := R.HGetAll(key).Result()
+	if err != nil && err != redis.Nil {
+		return CommandFile{}, errors.Wrapf(err, "could not access %s", key)
+	}
+	modesKey := fmt.Sprintf("chat:%d:commandParseModes", chatID)
+	modes, err := R.HGetAll(modesKey).Result()
+	if err != nil && err != redis.Nil {
+		return CommandFile{}, errors.Wrapf(err, "could not access %s", modesKey)
+	}
+	buttonsKey := fmt.Sprintf("chat:%d:commandButtons", chatID)
+	buttons, err := R.HGetAll(buttonsKey).Result()
+	if err != nil && err != redis.Nil {
+		return CommandFile{}, errors.Wrapf(err, "could not access %s", buttonsKey)
+	}
+	poolsKey := fmt.Sprintf("chat:%d:commandPools", chatID)
+	pools, err := R.HGetAll(poolsKey).Result()
+	if err != nil && err != redis.Nil {
+		return CommandFile{}, errors.Wrapf(err, "could not access %s", poolsKey)
+	}
+	f := CommandFile{Commands: map[string]ExportedCommand{}}
+	for name, text := range commands {
+		c := ExportedCommand{Response: text, ParseMode: modes[name]}
+		if data, ok := buttons[name]; ok {
+			c.Buttons = DecodeURLButtons([]byte(data))
+		}
+		if data, ok := pools[name]; ok {
+			pool := DecodeResponsePool([]byte(data))
+			c.Pool = &pool
+		}
+		f.Commands[name] = c
+	}
+	return f, nil
+}
+
+// downloads and parses a commands file a user uploaded
+func readCommandFile(m *tb.Message) (CommandFile, error) {
+	f := CommandFile{}
+	if m.Document == nil {
+		return f, errors.New("message has no document attached")
+	}
+	rc, err := B.GetFile(&m.Document.File)
+	if err != nil {
+		return f, errors.Wrap(err, "couldn't download document")
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return f, errors.Wrap(err, "couldn't read document")
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, errors.Wrap(err, "couldn't parse commands file")
+	}
+	if f.Commands == nil {
+		return f, errors.New("commands file doesn't contain any commands")
+	}
+	for name, c := range f.Commands {
+		if !strings.HasPrefix(name, "/") || strings.Contains(name, " ") {
+			return f, errors.Errorf("%s is not a valid command name", name)
+		}
+		if err := validateFormatting(c.Response, c.ParseMode); err != nil {
+			return f, errors.Wrapf(err, "%s isn't valid %s", name, c.ParseMode)
+		}
+		if c.Pool != nil && (len(c.Pool.Responses) == 0 ||
+			(c.Pool.Mode != PoolRandom && c.Pool.Mode != PoolSequence)) {
+			return f, errors.Errorf("%s has an invalid response pool", name)
+		}
+		if c.Pool != nil {
+			for _, r := range c.Pool.Responses {
+				if r.Weight <= 0 {
+					return f, errors.Errorf("%s has a response pool weight that isn't more than 0", name)
+				}
+			}
+		}
+		for _, row := range c.Buttons {
+			for _, b := range row {
+				if err := validateURLButton(b); err != nil {
+					return f, errors.Wrapf(err, "%s has an invalid button", name)
+				}
+			}
+		}
+	}
+	return f, nil
+}
+
+// a command without buttons can have them as nil or empty depending on
+// where it came from, which shouldn't count as a change
+func normalizeExportedCommand(c ExportedCommand) ExportedCommand {
+	if len(c.Buttons) == 0 {
+		c.Buttons = nil
+	}
+	return c
+}
+
+func diffCommandFiles(current CommandFile, imported CommandFile) CommandDiff {
+	d := CommandDiff{}
+	for name, c := range imported.Commands {
+		if existing, ok := current.Commands[name]; !ok {
+			d.Added = append(d.Added, name)
+		} else if !reflect.DeepEqual(normalizeExportedCommand(existing), normalizeExportedCommand(c)) {
+			d.Changed = append(d.Changed, name)
+		}
+	}
+	for name := range current.Commands {
+		if _, ok := imported.Commands[name]; !ok {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Changed)
+	sort.Strings(d.Removed)
+	return d
+}
+
+func exportCommands(ms []*tb.Message) (err error) {
+	m := ms[0]
+	chatID, chatTitle, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		B.Send(m.Sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	f, err := getCommandFile(chatID)
+	if err != nil {
+		B.Send(m.Sender, ErrorResponse)
+		return
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		B.Send(m.Sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't encode commands file")
+	}
+	doc := &tb.Document{
+		File:     tb.FromReader(bytes.NewReader(data)),
+		FileName: "commands.json",
+		Caption:  fmt.Sprintf("%d commands exported from %s", len(f.Commands), chatTitle),
+	}
+	if _, err = B.Send(m.Sender, doc); err != nil {
+		B.Send(m.Sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't send commands file")
+	}
+	return
+}
+
+// receives the uploaded file and the answer to the diff confirmation
+func importCommands(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	if len(ms) < 2 || ms[1].Text != "Apply" {
+		B.Send(sender, "Import cancelled, no commands were changed")
+		return
+	}
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	imported, err := readCommandFile(ms[0])
+	if err != nil {
+		B.Send(sender, fmt.Sprintf("I couldn't read that file: %s", err))
+		return
+	}
+	current, err := getCommandFile(chatID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return
+	}
+	d := diffCommandFiles(current, imported)
+	key := fmt.Sprintf("chat:%d:commands", chatID)
+	modesKey := fmt.Sprintf("chat:%d:commandParseModes", chatID)
+	buttonsKey := fmt.Sprintf("chat:%d:commandButtons", chatID)
+	poolsKey := fmt.Sprintf("chat:%d:commandPools", chatID)
+	// apply the whole import at once so a failure can't leave it half done
+	_, err = R.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, name := range append(d.Added, d.Changed...) {
+			c := imported.Commands[name]
+			pipe.HSet(key, name, c.Response)
+			pipe.HSet(modesKey, name, c.ParseMode)
+			if len(c.Buttons) > 0 {
+				pipe.HSet(buttonsKey, name, EncodeURLButtons(c.Buttons))
+			} else {
+				pipe.HDel(buttonsKey, name)
+			}
+			if c.Pool != nil {
+				pipe.HSet(poolsKey, name, EncodeResponsePool(c.Pool))
+			} else {
+				pipe.HDel(poolsKey, name)
+			}
+		}
+		for _, name := range d.Removed {
+			pipe.HDel(key, name)
+			pipe.HDel(modesKey, name)
+			pipe.HDel(buttonsKey, name)
+			pipe.HDel(poolsKey, name)
+		}
+		return nil
+	})
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't import commands into chat %d", chatID)
+	}
+	for _, change := range []struct {
+		reason   string
+		commands []string
+	}{
+		{"imported", d.Added},
+		{"changed by an import", d.Changed},
+		{"removed by an import", d.Removed},
+	} {
+		for _, name := range change.commands {
+			audit(AuditEntry{ChatID: int64(chatID), Action: AuditCommandChanged, Target: name, Reason: change.reason}.by(sender))
+		}
+	}
+	B.Send(sender, fmt.Sprintf("Imported commands into %s\n%s", chatTitle, d))
+	return
+}
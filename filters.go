@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// what happens to a message that matches a filter
+const (
+	FilterDelete = "Delete"
+	FilterWarn   = "Delete and Warn"
+	FilterMute   = "Mute"
+	FilterBan    = "Ban"
+)
+
+var FilterActionButtons = [][]string{{FilterDelete, FilterWarn}, {FilterMute, FilterBan}}
+
+// how long a filter or report mutes for when the chat hasn't set a warning mute time
+const defaultFilterMute = time.Hour
+
+// number of filters listed on each page of /viewfilters
+const filtersPerPage = 20
+
+// inline buttons that page through /viewfilters, their data is the page number
+var filterPageButton = tb.InlineButton{Unique: "filterpage"}
+
+// compiled regular expression filters keyed by pattern, so they aren't
+// compiled again for every message and join
+var filterPatterns = struct {
+	sync.RWMutex
+	m map[string]*regexp.Regexp
+}{m: map[string]*regexp.Regexp{}}
+
+func compileFilter(pattern string) (*regexp.Regexp, error) {
+	filterPatterns.RLock()
+	re, ok := filterPatterns.m[pattern]
+	filterPatterns.RUnlock()
+	if ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	filterPatterns.Lock()
+	filterPatterns.m[pattern] = re
+	filterPatterns.Unlock()
+	return re, nil
+}
+
+// drops a removed filter's pattern, it's compiled again if another chat still uses it
+func forgetFilter(pattern string) {
+	filterPatterns.Lock()
+	delete(filterPatterns.m, pattern)
+	filterPatterns.Unlock()
+}
+
+// a word, phrase or regular expression that isn't allowed in a chat, it
+// uses the same match kinds as auto-responders
+type FilterRule struct {
+	Kind    string
+	Pattern string
+	Action  string
+}
+
+func (f FilterRule) String() string {
+	return fmt.Sprintf("%s (%s) → %s", f.Pattern, strings.ToLower(f.Kind), f.Action)
+}
+
+// characters people swap in for letters to get around filters
+var leetReplacer = strings.NewReplacer(
+	"0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "8", "b",
+	"@", "a", "$", "s", "!", "i", "|", "l", "+", "t",
+)
+
+// strips invisible characters like zero width spaces and soft hyphens
+func stripInvisible(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// lowercases the text, undoes leetspeak and reduces everything other than
+// letters to single spaces so "D.M  m3" and "dm me" look the same
+func normalizeForFilter(text string) string {
+	words := strings.Fields(strings.ToLower(stripInvisible(text)))
+	for i, w := range words {
+		// punctuation ending a word is punctuation rather than leetspeak
+		words[i] = leetReplacer.Replace(strings.TrimRight(w, "!?.,;:"))
+	}
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return r
+		}
+		return ' '
+	}, strings.Join(words, " "))
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// keywords have to match whole words while phrases can appear anywhere,
+// regular expressions are tried against the text with and without normalizing
+func (f FilterRule) matches(text string, normalized string) bool {
+	switch f.Kind {
+	case TriggerKeyword:
+		return strings.Contains(" "+normalized+" ", " "+normalizeForFilter(f.Pattern)+" ")
+	case TriggerPhrase:
+		pattern := normalizeForFilter(f.Pattern)
+		return pattern != "" && strings.Contains(normalized, pattern)
+	case TriggerRegex:
+		re, err := compileFilter(f.Pattern)
+		if err != nil {
+			LogE.Printf("invalid filter %s: %s", f.Pattern, err)
+			return false
+		}
+		return re.MatchString(stripInvisible(text)) || re.MatchString(normalized)
+	}
+	return false
+}
+
+// when a mute from a filter or report ends, the chat's warning mute time
+// if it has one
+func defaultMuteUntil(chatID int64) int64 {
+	mute := defaultFilterMute
+	if minutes := getWarnSettings(chatID).MuteMinutes; minutes > 0 {
+		mute = time.Duration(minutes) * time.Minute
+	}
+	return time.Now().Add(mute).Unix()
+}
+
+func getFilterRules(chatID int64) ([]FilterRule, error) {
+	data, err := R.HGetAll(fmt.Sprintf("chat:%d:filters", chatID)).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't get filters for chat %d", chatID)
+	}
+	rules := []FilterRule{}
+	for _, d := range data {
+		rules = append(rules, DecodeFilterRule([]byte(d)))
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Pattern < rules[j].Pattern })
+	return rules, nil
+}
+
+// deletes a message from anyone other than an admin that matches one of
+// the chat's filters and takes the filter's action, returns whether it was deleted
+func removeMsgIfFiltered(m *tb.Message) bool {
+	text := strings.TrimSpace(m.Text + " " + m.Caption)
+	if text == "" || isKnownAdmin(m.Chat.ID, m.Sender.ID) {
+		return false
+	}
+	rules, err := getFilterRules(m.Chat.ID)
+	if err != nil {
+		LogE.Print(err)
+		return false
+	}
+	normalized := normalizeForFilter(text)
+	for _, f := range rules {
+		if !f.matches(text, normalized) {
+			continue
+		}
+		B.Delete(m)
+		LogI.Printf("deleted message from user %d in chat %d matching filter %s", m.Sender.ID, m.Chat.ID, f.Pattern)
+		entry := AuditEntry{ChatID: m.Chat.ID, Action: AuditDelete, Reason: "matched filter " + f.Pattern,
+			Link: messageLink(m)}.against(m.Sender)
+		audit(entry)
+		switch f.Action {
+		case FilterWarn:
+			if _, err := issueWarning(m.Chat, m.Sender, "using a filtered word", nil); err != nil {
+				LogE.Print(err)
+			}
+		case FilterMute:
+			if err := muteMember(m.Chat, m.Sender, defaultMuteUntil(m.Chat.ID)); err != nil {
+				LogE.Printf("couldn't mute user %d in chat %d: %s", m.Sender.ID, m.Chat.ID, err)
+			}
+			entry.Action = AuditMute
+			audit(entry)
+		case FilterBan:
+			if err := B.Ban(m.Chat, &tb.ChatMember{User: m.Sender, RestrictedUntil: tb.Forever()}); err != nil {
+				LogE.Printf("couldn't ban user %d from chat %d: %s", m.Sender.ID, m.Chat.ID, err)
+			}
+			entry.Action = AuditBan
+			audit(entry)
+			propagateBan(m.Chat, m.Sender, entry.Reason)
+		}
+		return true
+	}
+	return false
+}
+
+// receives the match kind, action and the filters, one per line
+func addFilters(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	kind, action := ms[0].Text, ms[1].Text
+	if kind != TriggerKeyword && kind != TriggerPhrase && kind != TriggerRegex {
+		B.Send(sender, fmt.Sprintf("No filters were added, %s isn't a way to match", kind))
+		return
+	}
+	switch action {
+	case FilterDelete, FilterWarn, FilterMute, FilterBan:
+	default:
+		B.Send(sender, fmt.Sprintf("No filters were added, %s isn't an action", action))
+		return
+	}
+	rules := map[string]interface{}{}
+	for _, line := range strings.Split(ms[2].Text, "\n") {
+		pattern := strings.TrimSpace(line)
+		if pattern == "" {
+			continue
+		}
+		if kind == TriggerRegex {
+			if _, err := regexp.Compile(pattern); err != nil {
+				B.Send(sender, fmt.Sprintf("No filters were added, %s isn't a valid regular expression: %s", pattern, err))
+				return nil
+			}
+		} else if normalizeForFilter(pattern) == "" {
+			B.Send(sender, fmt.Sprintf("No filters were added, %s doesn't have any letters or numbers", pattern))
+			return nil
+		}
+		rules[pattern] = EncodeFilterRule(&FilterRule{Kind: kind, Pattern: pattern, Action: action})
+	}
+	if len(rules) == 0 {
+		B.Send(sender, "No filters were added, send one word, phrase or regular expression per line")
+		return
+	}
+	if err = R.HMSet(fmt.Sprintf("chat:%d:filters", chatID), rules).Err(); err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't add filters to chat %d", chatID)
+	}
+	B.Send(sender, fmt.Sprintf("Added %d filters to %s", len(rules), chatTitle))
+	return
+}
+
+func removeFilter(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, _, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	removed, err := R.HDel(fmt.Sprintf("chat:%d:filters", chatID), ms[0].Text).Result()
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't remove filter from chat %d", chatID)
+	}
+	if removed == 0 {
+		B.Send(sender, ms[0].Text+" isn't one of the filters")
+		return
+	}
+	forgetFilter(ms[0].Text)
+	B.Send(sender, ms[0].Text+" has been removed from the filters")
+	return
+}
+
+// one page of the chat's filters with buttons to move between pages
+func filterPage(chatID int64, page int) (string, *tb.ReplyMarkup, error) {
+	rules, err := getFilterRules(chatID)
+	if err != nil {
+		return "", nil, err
+	}
+	title, _ := getChatTitle(int(chatID))
+	if len(rules) == 0 {
+		return title + " doesn't have any filters", &tb.ReplyMarkup{}, nil
+	}
+	pages := (len(rules) + filtersPerPage - 1) / filtersPerPage
+	if page < 0 || page >= pages {
+		page = 0
+	}
+	lines := []string{fmt.Sprintf("Filters for %s (page %d of %d)", title, page+1, pages)}
+	end := (page + 1) * filtersPerPage
+	if end > len(rules) {
+		end = len(rules)
+	}
+	for _, f := range rules[page*filtersPerPage : end] {
+		lines = append(lines, f.String())
+	}
+	row := []tb.InlineButton{}
+	if page > 0 {
+		prev := filterPageButton
+		prev.Text, prev.Data = "« Previous", strconv.Itoa(page-1)
+		row = append(row, prev)
+	}
+	if page < pages-1 {
+		next := filterPageButton
+		next.Text, next.Data = "Next »", strconv.Itoa(page+1)
+		row = append(row, next)
+	}
+	markup := &tb.ReplyMarkup{}
+	if len(row) > 0 {
+		markup.InlineKeyboard = [][]tb.InlineButton{row}
+	}
+	return strings.Join(lines, "\n"), markup, nil
+}
+
+func viewFilters(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, _, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	text, markup, err := filterPage(int64(chatID), 0)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return err
+	}
+	B.Send(sender, text, markup)
+	return
+}
+
+func onFilterPageCallback(c *tb.Callback) {
+	page, _ := strconv.Atoi(c.Data)
+	chatID, _, err := getUsersActiveChat(c.Sender.ID)
+	if err != nil {
+		B.Respond(c, &tb.CallbackResponse{Text: ErrorResponse})
+		return
+	}
+	text, markup, err := filterPage(int64(chatID), page)
+	if err != nil {
+		LogE.Print(err)
+		B.Respond(c, &tb.CallbackResponse{Text: ErrorResponse})
+		return
+	}
+	B.Edit(c.Message, text, markup)
+	B.Respond(c, &tb.CallbackResponse{})
+}
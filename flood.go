@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// what happens the third time a user floods the chat
+const (
+	FloodKick = "Kick"
+	FloodBan  = "Ban"
+)
+
+// how long a user's flood strikes are remembered
+const floodStrikeTTL = 24 * time.Hour
+
+// how long the notice about a muted or removed user stays up
+const floodNoticeTTL = 30 * time.Second
+
+// limits on what one user can send within the window, 0 turns a limit off
+type FloodSettings struct {
+	Messages    int
+	Window      int
+	Repeats     int
+	Media       int
+	MuteMinutes int
+	Action      string
+}
+
+func getFloodSettings(chatID int64) FloodSettings {
+	settings, _ := R.HGetAll(fmt.Sprintf("chat:%d:flood", chatID)).Result()
+	s := FloodSettings{Action: settings["action"]}
+	s.Messages, _ = strconv.Atoi(settings["messages"])
+	s.Window, _ = strconv.Atoi(settings["window"])
+	s.Repeats, _ = strconv.Atoi(settings["repeats"])
+	s.Media, _ = strconv.Atoi(settings["media"])
+	s.MuteMinutes, _ = strconv.Atoi(settings["muteMinutes"])
+	return s
+}
+
+// adds the member, usually a message ID, to a sliding window and returns
+// every member still in the window
+func floodWindow(key string, member interface{}, window time.Duration) ([]string, error) {
+	now := time.Now()
+	var ids *redis.StringSliceCmd
+	_, err := R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(key, redis.Z{Score: float64(now.UnixNano()), Member: member})
+		pipe.ZRemRangeByScore(key, "-inf", strconv.FormatInt(now.Add(-window).UnixNano(), 10))
+		ids = pipe.ZRange(key, 0, -1)
+		pipe.Expire(key, window)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't update flood window %s", key)
+	}
+	return ids.Val(), nil
+}
+
+// identical messages are matched on their text or the file they share
+func floodFingerprint(m *tb.Message) string {
+	content := strings.ToLower(strings.TrimSpace(m.Text + m.Caption))
+	switch {
+	case m.Sticker != nil:
+		content += m.Sticker.UniqueID
+	case m.Photo != nil:
+		content += m.Photo.UniqueID
+	case m.Animation != nil:
+		content += m.Animation.UniqueID
+	}
+	if content == "" {
+		return ""
+	}
+	sum := sha1.Sum([]byte(content))
+	return hex.EncodeToString(sum[:8])
+}
+
+func isFloodMedia(m *tb.Message) bool {
+	return m.Photo != nil || m.Video != nil || m.Animation != nil || m.Sticker != nil ||
+		m.Document != nil || m.Voice != nil || m.Audio != nil || m.VideoNote != nil
+}
+
+// counts the message against each of the chat's flood limits, returns the
+// IDs of the messages that make up the flood if a limit was exceeded
+func detectFlood(m *tb.Message, s FloodSettings) []string {
+	window := time.Duration(s.Window) * time.Second
+	check := func(limit int, key string) []string {
+		if limit <= 0 {
+			return nil
+		}
+		ids, err := floodWindow(key, m.ID, window)
+		if err != nil {
+			LogE.Print(err)
+			return nil
+		}
+		if len(ids) > limit {
+			return ids
+		}
+		return nil
+	}
+	flood := check(s.Messages, fmt.Sprintf("chat:%d:flood:%d", m.Chat.ID, m.Sender.ID))
+	if fingerprint := floodFingerprint(m); flood == nil && fingerprint != "" {
+		flood = check(s.Repeats, fmt.Sprintf("chat:%d:floodRepeats:%d:%s", m.Chat.ID, m.Sender.ID, fingerprint))
+	}
+	if flood == nil && isFloodMedia(m) {
+		flood = check(s.Media, fmt.Sprintf("chat:%d:floodMedia:%d", m.Chat.ID, m.Sender.ID))
+	}
+	return flood
+}
+
+// deletes the messages of a user flooding the chat and escalates each time
+// they do it, first muting them and then removing them, returns whether the
+// message was deleted
+func removeMsgIfFlooding(m *tb.Message) bool {
+	s := getFloodSettings(m.Chat.ID)
+	if s.Window <= 0 || isKnownAdmin(m.Chat.ID, m.Sender.ID) {
+		return false
+	}
+	flood := detectFlood(m, s)
+	if flood == nil {
+		return false
+	}
+	for _, id := range flood {
+		msgID, _ := strconv.Atoi(id)
+		B.Delete(&tb.Message{ID: msgID, Chat: m.Chat})
+	}
+	// start counting again so the rest of the burst doesn't add more strikes
+	windows := []string{fmt.Sprintf("chat:%d:flood:%d", m.Chat.ID, m.Sender.ID),
+		fmt.Sprintf("chat:%d:floodMedia:%d", m.Chat.ID, m.Sender.ID)}
+	if fingerprint := floodFingerprint(m); fingerprint != "" {
+		windows = append(windows, fmt.Sprintf("chat:%d:floodRepeats:%d:%s", m.Chat.ID, m.Sender.ID, fingerprint))
+	}
+	R.Del(windows...)
+
+	strikesKey := fmt.Sprintf("chat:%d:floodStrikes:%d", m.Chat.ID, m.Sender.ID)
+	strikes, _ := R.Incr(strikesKey).Result()
+	R.Expire(strikesKey, floodStrikeTTL)
+	name := displayName(m.Sender)
+	entry := AuditEntry{ChatID: m.Chat.ID, Action: AuditDelete, Reason: fmt.Sprintf("flooding, strike %d", strikes),
+		Link: messageLink(m)}.against(m.Sender)
+	audit(entry)
+	notice := ""
+	switch {
+	case strikes == 2 && s.MuteMinutes > 0:
+		until := time.Now().Add(time.Duration(s.MuteMinutes) * time.Minute)
+		if err := muteMember(m.Chat, m.Sender, until.Unix()); err != nil {
+			LogE.Printf("couldn't mute user %d in chat %d for flooding: %s", m.Sender.ID, m.Chat.ID, err)
+		}
+		notice = fmt.Sprintf("%s has been muted for %d minutes for flooding the chat", name, s.MuteMinutes)
+		entry.Action = AuditMute
+		audit(entry)
+	case strikes >= 3 && s.Action == FloodBan:
+		if err := B.Ban(m.Chat, &tb.ChatMember{User: m.Sender, RestrictedUntil: tb.Forever()}); err != nil {
+			LogE.Printf("couldn't ban user %d from chat %d for flooding: %s", m.Sender.ID, m.Chat.ID, err)
+		}
+		R.Del(strikesKey)
+		notice = fmt.Sprintf("%s has been banned for flooding the chat", name)
+		entry.Action = AuditBan
+		audit(entry)
+		propagateBan(m.Chat, m.Sender, "flooding")
+	case strikes >= 3:
+		if err := kickMember(m.Chat, m.Sender); err != nil {
+			LogE.Printf("couldn't kick user %d from chat %d for flooding: %s", m.Sender.ID, m.Chat.ID, err)
+		}
+		R.Del(strikesKey)
+		notice = fmt.Sprintf("%s has been removed for flooding the chat", name)
+		entry.Action = AuditKick
+		audit(entry)
+	}
+	LogI.Printf("user %d flooded chat %d, strike %d", m.Sender.ID, m.Chat.ID, strikes)
+	warnFromFilter(m, "flooding the chat")
+	if notice != "" {
+		if sent, err := B.Send(m.Chat, notice); err == nil {
+			deleteMessageLater(sent, floodNoticeTTL)
+		}
+	}
+	return true
+}
+
+// receives the message limit, window, repeat limit, media limit, mute minutes and final action
+func setFlood(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	names := []string{"message limit", "window", "repeat limit", "media limit", "mute time"}
+	values := []int{}
+	for i, name := range names {
+		v, err := strconv.Atoi(ms[i].Text)
+		if err != nil || v < 0 {
+			B.Send(sender, fmt.Sprintf("Flood protection wasn't saved, the %s needs to be a number", name))
+			return nil
+		}
+		values = append(values, v)
+	}
+	action := ms[5].Text
+	if action != FloodKick && action != FloodBan {
+		B.Send(sender, fmt.Sprintf("Flood protection wasn't saved, pick %s or %s", FloodKick, FloodBan))
+		return
+	}
+	key := fmt.Sprintf("chat:%d:flood", chatID)
+	err = R.HMSet(key, map[string]interface{}{
+		"messages":    values[0],
+		"window":      values[1],
+		"repeats":     values[2],
+		"media":       values[3],
+		"muteMinutes": values[4],
+		"action":      action,
+	}).Err()
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't save flood settings for chat %d", chatID)
+	}
+	if values[1] == 0 {
+		B.Send(sender, "Flood protection has been turned off for "+chatTitle)
+		return
+	}
+	B.Send(sender, fmt.Sprintf("Flood protection is on for %s, messages over the limit are deleted, "+
+		"the second time a user floods they're muted for %d minutes and the third time: %s",
+		chatTitle, values[4], action))
+	return
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// the parse modes a stored response (command, welcome, price) can be sent with
+const (
+	ParsePlain    = "Plain"
+	ParseMarkdown = "Markdown"
+	ParseHTML     = "HTML"
+)
+
+var ParseModeButtons = [][]string{{ParsePlain, ParseMarkdown, ParseHTML}}
+
+// converts a stored parse mode into the option passed to B.Send, anything
+// unknown (including responses saved before parse modes existed) is plain
+func parseModeFor(mode string) tb.ParseMode {
+	switch mode {
+	case ParseMarkdown:
+		return tb.ModeMarkdown
+	case ParseHTML:
+		return tb.ModeHTML
+	}
+	return tb.ModeDefault
+}
+
+// escapes user supplied text (like a username) before it is
+// substituted into a response of the given parse mode
+func escapeForParseMode(text string, mode string) string {
+	switch mode {
+	case ParseMarkdown:
+		return markdownEscaper.Replace(text)
+	case ParseHTML:
+		return html.EscapeString(text)
+	}
+	return text
+}
+
+var markdownEscaper = strings.NewReplacer("_", "\\_", "*", "\\*", "`", "\\`", "[", "\\[")
+
+// the function added to the end of every printing action of a template
+// rendered for a parse mode
+const templateEscaper = "escapeForParseMode"
+
+// renders a response template like renderTemplate, but everything the
+// template prints is escaped for the parse mode so a member's name can't
+// break the formatting or add links of its own
+func renderTemplateFor(name string, text string, data interface{}, mode string) (string, error) {
+	funcs := template.FuncMap{templateEscaper: func(v interface{}) string {
+		return escapeForParseMode(fmt.Sprint(v), mode)
+	}}
+	t, err := template.New(name).Funcs(funcs).Parse(text)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't parse template %s", name)
+	}
+	// borrow a parsed call to the escaper rather than building one by hand
+	escaper := template.Must(template.New("").Funcs(funcs).Parse("{{. | " + templateEscaper + "}}"))
+	escape := escaper.Tree.Root.Nodes[0].(*parse.ActionNode).Pipe.Cmds[1]
+	for _, tt := range t.Templates() {
+		if tt.Tree != nil {
+			escapeActions(tt.Tree.Root, escape)
+		}
+	}
+	by := bytes.Buffer{}
+	if err := t.Execute(&by, data); err != nil {
+		return "", errors.Wrapf(err, "couldn't execute template %s", name)
+	}
+	return by.String(), nil
+}
+
+// pipes the result of every action that prints something through escape,
+// the way html/template adds its escapers
+func escapeActions(node parse.Node, escape *parse.CommandNode) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			escapeActions(c, escape)
+		}
+	case *parse.ActionNode:
+		// assigning a variable doesn't print anything
+		if len(n.Pipe.Decl) == 0 {
+			n.Pipe.Cmds = append(n.Pipe.Cmds, escape)
+		}
+	case *parse.IfNode:
+		escapeActions(n.List, escape)
+		escapeActions(n.ElseList, escape)
+	case *parse.RangeNode:
+		escapeActions(n.List, escape)
+		escapeActions(n.ElseList, escape)
+	case *parse.WithNode:
+		escapeActions(n.List, escape)
+		escapeActions(n.ElseList, escape)
+	}
+}
+
+// checks text against the entity rules Telegram applies for the parse mode
+// so a response that would be rejected on every send is never saved
+func validateFormatting(text string, mode string) error {
+	switch mode {
+	case ParseMarkdown:
+		return validateMarkdown(text)
+	case ParseHTML:
+		return validateHTML(text)
+	}
+	return nil
+}
+
+var markdownEntityNames = map[byte]string{
+	'*': "bold",
+	'_': "italic",
+	'`': "code",
+}
+
+// legacy Markdown entities can't be nested, so each one just has to be closed
+func validateMarkdown(text string) error {
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch c {
+		case '\\':
+			if i+1 < len(text) && strings.IndexByte("_*`[", text[i+1]) >= 0 {
+				i++
+			}
+		case '*', '_', '`':
+			closing := string(c)
+			name := markdownEntityNames[c]
+			if strings.HasPrefix(text[i:], "```") {
+				closing = "```"
+				name = "pre"
+			}
+			end := strings.Index(text[i+len(closing):], closing)
+			if end < 0 {
+				return errors.Errorf("can't find end of %s entity at byte offset %d", name, i)
+			}
+			i += len(closing) + end + len(closing) - 1
+		case '[':
+			end := strings.Index(text[i:], "](")
+			if end < 0 {
+				return errors.Errorf("can't find end of text URL entity at byte offset %d", i)
+			}
+			urlEnd := strings.IndexByte(text[i+end:], ')')
+			if urlEnd < 0 {
+				return errors.Errorf("can't find end of URL at byte offset %d", i+end)
+			}
+			i += end + urlEnd
+		}
+	}
+	return nil
+}
+
+var (
+	htmlTagRx    = regexp.MustCompile(`^<(/?)([a-zA-Z0-9-]+)((?:\s+[a-zA-Z-]+\s*=\s*"[^"]*")*)\s*>`)
+	htmlEntityRx = regexp.MustCompile(`^&(?:lt|gt|amp|quot|#[0-9]+|#x[0-9a-fA-F]+);`)
+	// tags supported by Telegram and their equivalents
+	htmlTags = map[string]bool{
+		"b": true, "strong": true, "i": true, "em": true, "u": true, "ins": true,
+		"s": true, "strike": true, "del": true, "a": true, "code": true, "pre": true,
+		"span": true,
+	}
+)
+
+// tags have to be supported, properly nested and closed, and
+// any other < > or & has to be written as an entity
+func validateHTML(text string) error {
+	open := []string{}
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '<':
+			match := htmlTagRx.FindStringSubmatch(text[i:])
+			if match == nil {
+				return errors.Errorf("unclosed start tag at byte offset %d", i)
+			}
+			closing, name := match[1] == "/", strings.ToLower(match[2])
+			if !htmlTags[name] {
+				return errors.Errorf("unsupported start tag \"%s\" at byte offset %d", name, i)
+			}
+			if closing {
+				if len(open) == 0 || open[len(open)-1] != name {
+					return errors.Errorf("unexpected end tag \"%s\" at byte offset %d", name, i)
+				}
+				open = open[:len(open)-1]
+			} else {
+				if name == "a" && !strings.Contains(match[3], "href") {
+					return errors.Errorf("link at byte offset %d is missing an href", i)
+				}
+				open = append(open, name)
+			}
+			i += len(match[0]) - 1
+		case '>':
+			return errors.Errorf("unexpected > at byte offset %d, use &gt; instead", i)
+		case '&':
+			if !htmlEntityRx.MatchString(text[i:]) {
+				return errors.Errorf("unsupported entity at byte offset %d, use &amp; for &", i)
+			}
+		}
+	}
+	if len(open) > 0 {
+		return errors.Errorf("can't find end tag corresponding to start tag \"%s\"", open[len(open)-1])
+	}
+	return nil
+}
+
+// sends the admin the response exactly as the chat would see it, then
+// asks them to save it or go back and edit it
+func previewResponse(m *tb.Message, pr *Prompt, text string, mode string, markup *tb.ReplyMarkup) {
+	options := &tb.SendOptions{ParseMode: parseModeFor(mode), ReplyMarkup: markup}
+	if err := validateFormatting(text, mode); err != nil {
+		editResponse(pr, fmt.Sprintf("That isn't valid %s: %s", mode, err))
+		return
+	}
+	if _, err := B.Send(m.Sender, text, options); err != nil {
+		editResponse(pr, fmt.Sprintf("Telegram couldn't send that response: %s", err))
+		return
+	}
+	pr.Text = "This is how the response will look, would you like to save it?"
+	pr.Reply = tb.ReplyMarkup{
+		ReplyKeyboard:       [][]tb.ReplyButton{{{Text: "Save"}, {Text: "Edit"}}},
+		ResizeReplyKeyboard: true,
+		OneTimeKeyboard:     true,
+	}
+}
+
+// answers given so far to the path the user is on, ending with the message
+// that is being generated for since it hasn't been saved yet
+func previousResponses(m *tb.Message) []*tb.Message {
+	responses := []*tb.Message{}
+	if p := getUsersActivePath(m.Sender.ID); p != nil {
+		responses = append(responses, p.Responses...)
+	}
+	return append(responses, m)
+}
+
+// the command path answers are name, parse mode, response and buttons
+func PreviewCommandGenerator(m *tb.Message, pr *Prompt) {
+	ms := previousResponses(m)
+	if len(ms) < 4 {
+		*pr = ErrorPrompt
+		return
+	}
+	text, err := renderTemplateFor("preview", ms[2].Text, m, ms[1].Text)
+	if err != nil {
+		editResponse(pr, fmt.Sprintf("That response isn't a valid template: %s", errors.Cause(err)))
+		return
+	}
+	layout, err := parseURLButtons(ms[3].Text)
+	if err != nil {
+		editResponse(pr, fmt.Sprintf("Those buttons aren't valid: %s", err))
+		return
+	}
+	var markup *tb.ReplyMarkup
+	if len(layout) > 0 {
+		markup = &tb.ReplyMarkup{InlineKeyboard: getInlineKeyboardForURLButtons(layout)}
+	}
+	previewResponse(m, pr, text, ms[1].Text, markup)
+}
+
+// explains why the response can't be saved and offers to edit it or give up
+func editResponse(pr *Prompt, reason string) {
+	pr.Text = reason + "\nPress Edit to change it or Cancel to leave it unsaved"
+	pr.Reply = tb.ReplyMarkup{
+		ReplyKeyboard:       [][]tb.ReplyButton{{{Text: "Edit"}, {Text: "Cancel"}}},
+		ResizeReplyKeyboard: true,
+		OneTimeKeyboard:     true,
+	}
+}
+
+// the welcome path answers are parse mode and message
+func PreviewWelcomeGenerator(m *tb.Message, pr *Prompt) {
+	ms := previousResponses(m)
+	if len(ms) < 2 {
+		*pr = ErrorPrompt
+		return
+	}
+	mode := ms[0].Text
+	text := strings.Replace(ms[1].Text, "$username", escapeForParseMode(m.Sender.Username, mode), -1)
+	previewResponse(m, pr, text, mode, nil)
+}
+
+// the price path answers are slug, conversion, parse mode and message format
+func PreviewPriceGenerator(m *tb.Message, pr *Prompt) {
+	ms := previousResponses(m)
+	if len(ms) < 4 {
+		*pr = ErrorPrompt
+		return
+	}
+	token := Token{Name: "Ethereum", Symbol: "ETH"}
+	text := formatPriceMessage(ms[3].Text, ms[0].Text, token, 1234.5, 0.05, 2.5, -1.2)
+	previewResponse(m, pr, text, ms[2].Text, nil)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// hash of lowercased usernames to IDs for users beru has seen post in a group
+const usernamesKey = "beru:usernames"
+
+// commands moderators use inside the group itself rather than through a path
+var GroupCommandRegistry = map[string]func(*tb.Message){
+	"/warn":       wrapGroupCommand(warnUser),
+	"/unwarn":     wrapGroupCommand(unwarnUser),
+	"/warnings":   wrapGroupCommand(viewWarnings),
+	"/resetwarns": wrapGroupCommand(resetWarnings),
+	"/ban":        wrapModerationCommand(banCommand),
+	"/tban":       wrapModerationCommand(tempBanCommand),
+	"/unban":      wrapModerationCommand(unbanCommand),
+	"/kick":       wrapModerationCommand(kickCommand),
+	"/mute":       wrapModerationCommand(muteCommand),
+	"/unmute":     wrapModerationCommand(unmuteCommand),
+	"/purge":      wrapModerationCommand(purgeCommand),
+	"/report":     reportCommand,
+}
+
+// only runs the command for beru admins of the group it was sent in
+func wrapGroupCommand(handler func(*tb.Message)) func(*tb.Message) {
+	return func(m *tb.Message) {
+		if m.Private() || m.Sender == nil {
+			return
+		}
+		if !isActiveAdmin(m.Sender.ID, m.Chat.ID) {
+			B.Reply(m, "Only admins of this chat can use "+strings.Fields(m.Text)[0])
+			return
+		}
+		handler(m)
+	}
+}
+
+// commands that act on people also need the sender to still be an
+// admin in telegram, so a demoted moderator can't use them
+func wrapModerationCommand(handler func(*tb.Message)) func(*tb.Message) {
+	return wrapGroupCommand(func(m *tb.Message) {
+		if !isTelegramAdmin(m.Chat.ID, m.Sender.ID) {
+			B.Reply(m, "Only admins of this chat can use "+strings.Fields(m.Text)[0])
+			return
+		}
+		handler(m)
+	})
+}
+
+// keeps the user's ID so commands can name them by username
+func rememberUser(u *tb.User) {
+	if u.Username != "" {
+		R.HSet(usernamesKey, strings.ToLower(u.Username), u.ID)
+	}
+}
+
+// works out who a group command is about, either the sender of the message
+// it replies to or the user named first, and returns the rest of the arguments
+func targetOf(m *tb.Message) (*tb.User, string, error) {
+	payload := strings.TrimSpace(m.Payload)
+	if m.ReplyTo != nil && m.ReplyTo.Sender != nil {
+		return m.ReplyTo.Sender, payload, nil
+	}
+	for _, e := range m.Entities {
+		// users without a username are mentioned by a link to their profile
+		if e.Type == tb.EntityTMention && e.User != nil {
+			rest := strings.Replace(payload, entityText(m.Text, e), "", 1)
+			return e.User, strings.TrimSpace(rest), nil
+		}
+	}
+	fields := strings.Fields(payload)
+	if len(fields) == 0 {
+		return nil, "", errors.New("reply to one of their messages or name them with @username")
+	}
+	rest := strings.TrimSpace(strings.TrimPrefix(payload, fields[0]))
+	if id, err := strconv.Atoi(fields[0]); err == nil {
+		return &tb.User{ID: id}, rest, nil
+	}
+	username := strings.TrimPrefix(fields[0], "@")
+	id, err := R.HGet(usernamesKey, strings.ToLower(username)).Int()
+	if err != nil {
+		return nil, "", errors.Errorf("I haven't seen %s post yet, reply to one of their messages instead", fields[0])
+	}
+	return &tb.User{ID: id, Username: username}, rest, nil
+}
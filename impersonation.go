@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// turns impersonation protection off, the other settings are the name filter actions
+const ImpersonationOff = "Off"
+
+// names shorter than this have to look exactly like an admin's, anything
+// longer that's one edit away is held for review rather than banned
+const minFuzzyNameLength = 8
+
+// letters from other scripts that look like latin ones
+var homoglyphReplacer = strings.NewReplacer(
+	// cyrillic
+	"а", "a", "в", "b", "е", "e", "ё", "e", "к", "k", "м", "m", "н", "h", "о", "o",
+	"р", "p", "с", "c", "т", "t", "у", "y", "х", "x", "ѕ", "s", "і", "i", "ї", "i",
+	"ј", "j", "ԁ", "d", "ԛ", "q", "ԝ", "w", "ӏ", "l", "һ", "h",
+	// greek
+	"α", "a", "β", "b", "ε", "e", "η", "n", "ι", "i", "κ", "k", "ν", "v", "ο", "o",
+	"ρ", "p", "τ", "t", "υ", "u", "χ", "x", "ω", "w",
+	// latin lookalikes
+	"ɑ", "a", "ɡ", "g", "ı", "i", "ȷ", "j", "ł", "l", "ø", "o", "ß", "b",
+)
+
+// characters and pairs that are easy to mistake for each other once
+// everything is lowercase, reduced to one spelling
+var confusableReplacer = strings.NewReplacer(
+	"rn", "m", "vv", "w",
+	"0", "o", "1", "l", "i", "l", "|", "l", "5", "s", "3", "e", "4", "a", "@", "a", "$", "s",
+	"_", "", ".", "", "-", "",
+)
+
+// reduces a name to what it looks like, so "Аdmin_J0hn" written with a
+// cyrillic А and "admin john" end up the same
+func nameSkeleton(name string) string {
+	name = strings.ToLower(stripInvisible(name))
+	name = strings.Map(func(r rune) rune {
+		// fullwidth forms of ascii characters
+		if r >= '\uFF01' && r <= '\uFF5E' {
+			r -= 0xFEE0
+		}
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = confusableReplacer.Replace(homoglyphReplacer.Replace(name))
+	return strings.Join(strings.Fields(name), "")
+}
+
+// the number of single character edits to turn one string into the other
+func editDistance(a string, b string) int {
+	s, t := []rune(a), []rune(b)
+	prev := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		cur := make([]int, len(t)+1)
+		cur[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(t)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// whether the names are the same once lookalike characters are swapped
+func looksAlike(a string, b string) bool {
+	a, b = nameSkeleton(a), nameSkeleton(b)
+	return a != "" && a == b
+}
+
+// the name ignoring only case, spacing and separators, two names that look
+// alike but differ here needed lookalike characters swapped to match, which
+// is only done on purpose so it's safe to ban for
+func plainName(name string) string {
+	name = strings.ToLower(stripInvisible(name))
+	name = strings.NewReplacer("_", "", ".", "", "-", "").Replace(name)
+	return strings.Join(strings.Fields(name), "")
+}
+
+// whether long names are one edit apart, which real names can be by
+// chance so it's only reason enough for a review
+func nearlyAlike(a string, b string) bool {
+	a, b = nameSkeleton(a), nameSkeleton(b)
+	if len([]rune(a)) < minFuzzyNameLength || len([]rune(b)) < minFuzzyNameLength {
+		return false
+	}
+	return editDistance(a, b) <= 1
+}
+
+// the names a user shows up as, labeled for the alert
+func namesOf(u *tb.User) map[string]string {
+	names := map[string]string{}
+	if full := strings.TrimSpace(u.FirstName + " " + u.LastName); full != "" {
+		names["name"] = full
+	}
+	if u.Username != "" {
+		names["username"] = u.Username
+	}
+	return names
+}
+
+// the chat admin whose name or username the user's looks like, nil if
+// there isn't one, names are only compared with names and usernames with
+// usernames, disguised is only true when lookalike characters were used
+func impersonatedAdmin(chatID int64, u *tb.User) (admin *tb.User, reason string, disguised bool) {
+	admins, err := R.SMembers(fmt.Sprintf("chat:%d:admins", chatID)).Result()
+	if err != nil {
+		LogE.Printf("couldn't get admins of chat %d to check for impersonators: %s", chatID, err)
+		return nil, "", false
+	}
+	names := namesOf(u)
+	for _, a := range admins {
+		adminID, _ := strconv.Atoi(a)
+		if adminID == u.ID {
+			continue
+		}
+		candidate := knownUser(adminID)
+		for label, adminName := range namesOf(candidate) {
+			name, ok := names[label]
+			if !ok {
+				continue
+			}
+			alike := looksAlike(name, adminName)
+			if alike && plainName(name) != plainName(adminName) {
+				return candidate, fmt.Sprintf("%s looks like %s's", label, displayName(candidate)), true
+			}
+			// keep looking for a disguised name before settling for one that's
+			// the same or nearly, a member can share a name with an admin
+			if admin == nil && alike {
+				admin, reason = candidate, fmt.Sprintf("%s is the same as %s's", label, displayName(candidate))
+			} else if admin == nil && nearlyAlike(name, adminName) {
+				admin, reason = candidate, fmt.Sprintf("%s is one letter off %s's", label, displayName(candidate))
+			}
+		}
+	}
+	return admin, reason, false
+}
+
+// bans or mutes a user whose name looks like one of the chat's admins and
+// tells the admins, returns whether anything was done
+func catchImpersonator(chat *tb.Chat, u *tb.User) bool {
+	action, err := R.Get(fmt.Sprintf("chat:%d:impersonation", chat.ID)).Result()
+	if err != nil || (action != NameBan && action != NameReview) {
+		return false
+	}
+	admin, reason, disguised := impersonatedAdmin(chat.ID, u)
+	if admin == nil {
+		return false
+	}
+	LogI.Printf("user %d in chat %d: %s", u.ID, chat.ID, reason)
+	title, _ := getChatTitle(int(chat.ID))
+	entry := AuditEntry{ChatID: chat.ID, Reason: reason}.against(u)
+	// someone could really have the same or a similar name, so an admin decides
+	if action == NameBan && disguised {
+		if err := B.Ban(chat, &tb.ChatMember{User: u, RestrictedUntil: tb.Forever()}); err != nil {
+			LogE.Printf("couldn't ban user %d from chat %d: %s", u.ID, chat.ID, err)
+			return false
+		}
+		entry.Action = AuditBan
+		audit(entry)
+		// only this chat's admins are being impersonated, so the ban isn't
+		// shared with the chat's ban lists
+		alertAdmins(chat.ID, fmt.Sprintf("I banned %s (%d) from %s because their %s", displayName(u), u.ID, title, reason))
+	} else {
+		if err := muteMember(chat, u, tb.Forever()); err != nil {
+			LogE.Printf("couldn't mute user %d in chat %d: %s", u.ID, chat.ID, err)
+			return false
+		}
+		entry.Action, entry.Reason = AuditMute, reason+", waiting for review"
+		audit(entry)
+		requestNameReview(chat, u, reason)
+	}
+	// the admin being impersonated only hears about it if they've started a chat with beru
+	B.Send(admin, fmt.Sprintf("%s (%d) joined %s pretending to be you and may message members as you",
+		displayName(u), u.ID, title))
+	return true
+}
+
+// sends the same message to each of the chat's active admins
+func alertAdmins(chatID int64, text string) {
+	admins, err := R.SMembers(fmt.Sprintf("chat:%d:activeAdmins", chatID)).Result()
+	if err != nil {
+		LogE.Printf("couldn't get admins of chat %d to alert: %s", chatID, err)
+		return
+	}
+	for _, a := range admins {
+		adminID, _ := strconv.Atoi(a)
+		B.Send(&tb.User{ID: adminID}, text)
+	}
+}
+
+// receives Off or what happens to users whose name looks like an admin's
+func setImpersonation(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	action := ms[0].Text
+	switch action {
+	case NameBan, NameReview, ImpersonationOff:
+	default:
+		B.Send(sender, fmt.Sprintf("Impersonation protection wasn't saved, %s isn't an action", action))
+		return
+	}
+	if err = R.Set(fmt.Sprintf("chat:%d:impersonation", chatID), action, 0).Err(); err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't save impersonation protection for chat %d", chatID)
+	}
+	if action == ImpersonationOff {
+		B.Send(sender, "Impersonation protection has been turned off for "+chatTitle)
+		return
+	}
+	outcome := "banned if they use lookalike characters, names that are the same or one letter off " +
+		"will be muted until an admin reviews them"
+	if action == NameReview {
+		outcome = "muted until an admin reviews them"
+	}
+	B.Send(sender, fmt.Sprintf("Users in %s with a name like one of its admins will be %s. "+
+		"Make sure I'm an admin that can ban users", chatTitle, outcome))
+	return
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"fmt"
+	"time"
+
 	"github.com/go-redis/redis"
 	"github.com/pkg/errors"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
 
+// how long the cached telegram admins of a chat are trusted before they're
+// fetched again, so promotions and demotions are picked up
+const adminCacheTTL = 10 * time.Minute
+
 func userHasAdminManagementAccess(userID int, chatID int) (bool, error) {
 	owner, err := R.Get(fmt.Sprintf("chat:%d:owner", chatID)).Int64()
 	if err != redis.Nil {
@@ -52,17 +58,90 @@ func getUserName(userID int) (string, error) {
 	}
 }
 
+// replaces the cached telegram admins of the chat so demoted admins drop out
 func updateChatAdmins(chatID int) error {
-	if members, err := B.AdminsOf(&tb.Chat{ID: int64(chatID)}); err != nil {
-		LogE.Printf("error fetching admins for chat %s", chatID)
+	members, err := B.AdminsOf(&tb.Chat{ID: int64(chatID)})
+	if err != nil {
+		LogE.Printf("error fetching admins for chat %d", chatID)
 		return err
-	} else {
-		for _, u := range members {
-			// update all info for chat admins in case any have changed
-			R.Set(fmt.Sprintf("user:%d:info", u.User.ID),
-				EncodeUser(u.User), 0)
-			R.SAdd(fmt.Sprintf("chat:%d:admins", chatID), u.User.ID)
+	}
+	ids := []interface{}{}
+	for _, u := range members {
+		// update all info for chat admins in case any have changed
+		R.Set(fmt.Sprintf("user:%d:info", u.User.ID),
+			EncodeUser(u.User), 0)
+		ids = append(ids, u.User.ID)
+	}
+	key := fmt.Sprintf("chat:%d:admins", chatID)
+	_, err = R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(key)
+		if len(ids) > 0 {
+			pipe.SAdd(key, ids...)
+		}
+		pipe.Set(fmt.Sprintf("chat:%d:adminsFresh", chatID), 1, adminCacheTTL)
+		return nil
+	})
+	return err
+}
+
+// the user as beru last saw them, or just their ID if it never has
+func knownUser(userID int) *tb.User {
+	data, err := R.Get(fmt.Sprintf("user:%d:info", userID)).Bytes()
+	if err != nil {
+		return &tb.User{ID: userID}
+	}
+	return DecodeUser(data)
+}
+
+// how a user is referred to in messages beru posts
+func displayName(u *tb.User) string {
+	if u.Username != "" {
+		return "@" + u.Username
+	}
+	if u.FirstName != "" {
+		return u.FirstName
+	}
+	return fmt.Sprintf("user %d", u.ID)
+}
+
+// whether the user can manage the chat through beru
+func isActiveAdmin(userID int, chatID int64) bool {
+	ok, _ := R.SIsMember(fmt.Sprintf("chat:%d:activeAdmins", chatID), userID).Result()
+	return ok
+}
+
+// a quicker check than isChatAdmin for every message, using the
+// telegram admins cached when they were last updated
+func isKnownAdmin(chatID int64, userID int) bool {
+	if isActiveAdmin(userID, chatID) {
+		return true
+	}
+	// the first check after the cache goes stale fetches the admins again
+	if ok, _ := R.SetNX(fmt.Sprintf("chat:%d:adminsFresh", chatID), 1, adminCacheTTL).Result(); ok {
+		if err := updateChatAdmins(int(chatID)); err != nil {
+			LogE.Printf("couldn't refresh admins of chat %d: %s", chatID, err)
+		}
+	}
+	ok, _ := R.SIsMember(fmt.Sprintf("chat:%d:admins", chatID), userID).Result()
+	return ok
+}
+
+// whether the user is a beru admin of the chat or an admin in telegram
+func isChatAdmin(chatID int64, userID int) bool {
+	return isActiveAdmin(userID, chatID) || isTelegramAdmin(chatID, userID)
+}
+
+// asks telegram whether the user is currently an admin of the chat
+func isTelegramAdmin(chatID int64, userID int) bool {
+	member, err := B.ChatMemberOf(&tb.Chat{ID: chatID}, &tb.User{ID: userID})
+	return err == nil && (member.Role == tb.Administrator || member.Role == tb.Creator)
+}
+
+func containsInt(ints []int, i int) bool {
+	for _, v := range ints {
+		if v == i {
+			return true
 		}
 	}
-	return nil
+	return false
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// the domain lists a chat keeps, links to subdomains of a listed domain match too
+const (
+	DomainAllowlist = "Allow"
+	DomainDenylist  = "Deny"
+)
+
+func domainListKey(chatID int64, list string) string {
+	if list == DomainDenylist {
+		return fmt.Sprintf("chat:%d:domainDenylist", chatID)
+	}
+	return fmt.Sprintf("chat:%d:domainAllowlist", chatID)
+}
+
+// text covered by an entity, telegram measures offsets in UTF-16 code units
+func entityText(text string, e tb.MessageEntity) string {
+	encoded := utf16.Encode([]rune(text))
+	if e.Offset < 0 || e.Length < 0 || e.Offset+e.Length > len(encoded) {
+		return ""
+	}
+	return string(utf16.Decode(encoded[e.Offset : e.Offset+e.Length]))
+}
+
+// every link telegram found in the message or caption, including
+// the targets of links hidden behind anchor text
+func messageLinks(m *tb.Message) []string {
+	links := []string{}
+	collect := func(text string, entities []tb.MessageEntity) {
+		for _, e := range entities {
+			switch e.Type {
+			case tb.EntityURL:
+				links = append(links, entityText(text, e))
+			case tb.EntityTextLink:
+				links = append(links, e.URL)
+			}
+		}
+	}
+	collect(m.Text, m.Entities)
+	collect(m.Caption, m.CaptionEntities)
+	return links
+}
+
+// lowercased host of a link without the port or a leading www.
+func linkDomain(link string) string {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// turns whatever an admin typed (a bare domain or a whole link) into a domain
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(linkDomain(strings.TrimSpace(domain)), ".")
+}
+
+func domainListed(domain string, list []string) bool {
+	for _, d := range list {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func getDomainList(chatID int64, list string) []string {
+	domains, err := R.SMembers(domainListKey(chatID, list)).Result()
+	if err != nil {
+		LogE.Printf("couldn't get %s list for chat %d: %s", list, chatID, err)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// the domains of links in the message that aren't on the chat's allowlist
+func unapprovedDomains(m *tb.Message) []string {
+	allowed := getDomainList(m.Chat.ID, DomainAllowlist)
+	domains := []string{}
+	for _, link := range messageLinks(m) {
+		if d := linkDomain(link); d != "" && !domainListed(d, allowed) {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// deletes a message linking to a denylisted domain no matter who posted it,
+// returns whether it was deleted
+func removeMsgIfDenylisted(m *tb.Message) bool {
+	denied := getDomainList(m.Chat.ID, DomainDenylist)
+	if len(denied) == 0 {
+		return false
+	}
+	for _, link := range messageLinks(m) {
+		if domainListed(linkDomain(link), denied) {
+			B.Delete(m)
+			audit(AuditEntry{ChatID: m.Chat.ID, Action: AuditDelete, Reason: "linked to " + linkDomain(link),
+				Link: messageLink(m)}.against(m.Sender))
+			warnFromFilter(m, "posting a link to "+linkDomain(link))
+			return true
+		}
+	}
+	return false
+}
+
+// splits a message of domains separated by spaces, commas or new lines
+func parseDomains(text string) ([]string, error) {
+	domains := []string{}
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n'
+	}) {
+		d := normalizeDomain(field)
+		if d == "" || !strings.Contains(d, ".") {
+			return nil, errors.Errorf("%s isn't a domain", field)
+		}
+		domains = append(domains, d)
+	}
+	if len(domains) == 0 {
+		return nil, errors.New("you need to send at least one domain")
+	}
+	return domains, nil
+}
+
+func addDomains(ms []*tb.Message, list string) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	domains, err := parseDomains(ms[0].Text)
+	if err != nil {
+		B.Send(sender, fmt.Sprintf("No domains were added, %s", err))
+		return nil
+	}
+	members := []interface{}{}
+	for _, d := range domains {
+		members = append(members, d)
+	}
+	// a domain can only be on one of the lists
+	other := DomainDenylist
+	if list == DomainDenylist {
+		other = DomainAllowlist
+	}
+	_, err = R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SRem(domainListKey(int64(chatID), other), members...)
+		pipe.SAdd(domainListKey(int64(chatID), list), members...)
+		return nil
+	})
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't update %s list for chat %d", list, chatID)
+	}
+	if list == DomainDenylist {
+		B.Send(sender, fmt.Sprintf("Links to %s will be deleted from %s", strings.Join(domains, ", "), chatTitle))
+	} else {
+		B.Send(sender, fmt.Sprintf("New users in %s can now link to %s", chatTitle, strings.Join(domains, ", ")))
+	}
+	return
+}
+
+func allowDomains(ms []*tb.Message) error {
+	return addDomains(ms, DomainAllowlist)
+}
+
+func denyDomains(ms []*tb.Message) error {
+	return addDomains(ms, DomainDenylist)
+}
+
+func removeDomain(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, _, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	domain := normalizeDomain(ms[0].Text)
+	_, err = R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SRem(domainListKey(int64(chatID), DomainAllowlist), domain)
+		pipe.SRem(domainListKey(int64(chatID), DomainDenylist), domain)
+		return nil
+	})
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't remove domain %s from chat %d", domain, chatID)
+	}
+	B.Send(sender, domain+" has been removed from the domain lists")
+	return
+}
+
+func viewDomains(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	allowed := getDomainList(int64(chatID), DomainAllowlist)
+	denied := getDomainList(int64(chatID), DomainDenylist)
+	if len(allowed) == 0 && len(denied) == 0 {
+		B.Send(sender, chatTitle+" doesn't have any allowed or denied domains")
+		return
+	}
+	msg := fmt.Sprintf("Domain lists for %s\n", chatTitle)
+	msg += fmt.Sprintf("\nAllowed for new users:\n%s\n", strings.Join(allowed, "\n"))
+	msg += fmt.Sprintf("\nDenied for everyone:\n%s", strings.Join(denied, "\n"))
+	B.Send(sender, msg)
+	return
+}
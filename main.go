@@ -1,18 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"encoding/gob"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"strings"
-	"text/template"
 	"time"
 	"github.com/go-redis/redis"
 	tb "gopkg.in/tucnak/telebot.v2"
-	"strconv"
-	"regexp"
 )
 
 /*
@@ -20,23 +17,109 @@ STATE GUIDE
 KEY FORMAT == type:instance:attribute
 
 beru:chats <SET> : chats beru has been invited to
+beru:schedules <ZSET> : "chatID:scheduleID" of every active schedule scored by next run time
+beru:jobs <ZSET> : IDs of one off jobs scored by the time they should run
+beru:job:%jobID <Job> : gob encoded job waiting in beru:jobs
+beru:jobCounter <int> : last job ID handed out
+beru:botUsernames <MAP> : lowercased usernames of bots beru has seen to their user IDs
+beru:usernames <MAP> : lowercased usernames of users beru has seen post in a group to their user IDs
 
 chat:%chatID:admins <SET> : admins for this chat that can access beru admin commands
+chat:%chatID:adminsFresh <int> : set while the cached admins are recent enough to trust
 chat:%chatID:owner <int> : super user/owner of chat, user that invited beru, can modify
 	admin set
 chat:%chatID:commands <MAP> : map of command names to static replies
+chat:%chatID:commandParseModes <MAP> : map of command names to the parse mode of their reply
+chat:%chatID:commandButtons <MAP> : map of command names to gob encoded rows of URLButtons
+chat:%chatID:commandPools <MAP> : map of command names to gob encoded ResponsePools
 chat:%chatID:title <string> : name of chat
 chat:%chatID:usersJoinedCount <int> : number of users joined since beru started tracking
 chat:%chatID:usersJoinedLimit <int> : number of users joined before beru posts welcome message
 chat:%chatID:usersJoinedMessage <string> : welcome message to post
+chat:%chatID:usersJoinedParseMode <string> : parse mode of the welcome message
+chat:%chatID:autoResponders <MAP> : map of "kind:trigger" to gob encoded AutoResponders
+chat:%chatID:autoResponderCooldown:%kind:%trigger <string> : set while an auto-responder is cooling down
+chat:%chatID:schedules <MAP> : map of schedule IDs to gob encoded Schedules
+chat:%chatID:scheduleCounter <int> : last schedule ID handed out in this chat
+chat:%chatID:mediaPolicy <SET> : content types restricted users can't post
+chat:%chatID:nativeRestriction <int> : 1 if new users are restricted by telegram instead of having media deleted
+chat:%chatID:domainAllowlist <SET> : domains restricted users can still link to
+chat:%chatID:domainDenylist <SET> : domains nobody can link to
+chat:%chatID:addressGuard <int> : 1 if wallet and contract addresses from non-admins are deleted
+chat:%chatID:addressAllowlist <MAP> : map of official addresses, lowercase if they aren't case sensitive, to their chain
+chat:%chatID:botWhitelist <SET> : user IDs of bots allowed to join
+chat:%chatID:blockedBots <MAP> : bot IDs to gob encoded BlockedBots removed from the chat
+chat:%chatID:captchaSettings <MAP> : the challenge new users have to solve before they can chat
+	.mode <string> : Off, Button, Arithmetic or Emoji
+	.timeout <int> : seconds to answer before being kicked
+chat:%chatID:captcha:%userID <Captcha> : gob encoded challenge the user hasn't answered yet, expires shortly after the timeout
+chat:%chatID:flood <MAP> : limits on what one user can send within the window, 0 turns a limit off
+	.messages <int> : messages
+	.window <int> : length of the window in seconds, 0 turns flood protection off
+	.repeats <int> : identical messages
+	.media <int> : photos, videos, GIFs, stickers and files
+	.muteMinutes <int> : how long a user is muted the second time they flood
+	.action <string> : Kick or Ban the third time they flood
+chat:%chatID:flood:%userID <ZSET> : IDs of the user's messages in the window scored by when they were sent
+chat:%chatID:floodRepeats:%userID:%hash <ZSET> : IDs of the user's identical messages in the window
+chat:%chatID:floodMedia:%userID <ZSET> : IDs of the user's media messages in the window
+chat:%chatID:floodStrikes:%userID <int> : times the user has flooded the chat in the last day
+chat:%chatID:raid <MAP> : when a chat is locked down
+	.joins <int> : joins allowed within the window, 0 turns raid protection off
+	.window <int> : length of the window in seconds
+	.coolDown <int> : minutes a lockdown lasts
+	.silence <string> : Yes if only admins can talk during a lockdown
+chat:%chatID:joins <ZSET> : IDs of users that joined in the window scored by when they joined
+chat:%chatID:lockdown <int64> : unix time the chat's lockdown ends
+chat:%chatID:lockdownSilenced <int> : set while a lockdown has silenced everyone other than admins
+chat:%chatID:nightMode <MAP> : the chat's quiet hours
+	.mode <string> : Off, Media and Links or Everything
+	.start <int> : minutes after midnight quiet hours start
+	.end <int> : minutes after midnight quiet hours end
+	.timezone <string> : IANA timezone the times are in
+	.notice <string> : posted when quiet hours start, empty for none
+chat:%chatID:nightActive <string> : mode of the quiet hours the chat is in
+chat:%chatID:basePermissions <bytes> : gob encoded permissions the chat had before night mode or a
+	lockdown restricted it, kept until neither is active
+chat:%chatID:nightNotice <int> : ID of the notice posted when quiet hours started
+chat:%chatID:warnSettings <MAP> : how warnings are handled
+	.expiryHours <int> : hours a warning counts for, 0 if they never expire
+	.muteAt <int> : warnings before a user is muted, 0 to never mute
+	.muteMinutes <int> : how long they are muted for
+	.kickAt <int> : warnings before a user is removed, 0 to never remove
+	.banAt <int> : warnings before a user is banned, 0 to never ban
+	.filters <string> : Yes if flood protection, denied domains and the address guard warn users
+chat:%chatID:warnings:%userID <LIST> : gob encoded Warnings given to the user, oldest first
+chat:%chatID:auditLog <STREAM> : moderation actions with fields action, actorID, actor, targetID, target, reason and link
+chat:%chatID:auditChannel <int64> : ID of the channel or group moderation actions are posted to
+chat:%chatID:reported:%messageID <int> : ID of the user who reported the message, so it's only reported once
+report:%reportID <bytes> : gob encoded Report waiting for an admin to act on it
+report:%reportID:resolved <int> : ID of the admin who acted on the report first
+beru:reportCounter <int> : last report ID handed out
+chat:%chatID:undo:%messageID <string> : "action:userID" the undo button on a moderation command's confirmation reverses
+chat:%chatID:filters <MAP> : map of banned words, phrases and regexes to gob encoded FilterRules
+chat:%chatID:nameFilters <MAP> : map of patterns, or the kind of a built in check, to gob encoded FilterRules matched against names
+chat:%chatID:memberNames <MAP> : map of userIDs to their first name, last name and username when last seen
+chat:%chatID:nameReview:%userID <string> : why a user muted by a name filter is waiting for an admin to review them
+chat:%chatID:impersonation <string> : Off, Ban or Mute for Review for users whose name looks like an admin's
+chat:%chatID:blockedBot <MAP> : how bots that aren't whitelisted are handled
+	.action <string> : Ban, Kick or Ban Bot and Adder
+	.notice <string> : template posted in the chat, empty for no notice
+	.noticeTTL <int> : seconds before the notice is deleted, 0 to keep it
 chat:%chatID:price <MAP> : details for the price command
 	.slug <string> : the slug identifier on CMC for the token, found in the url
 	.conversion <string> : the fiat or crypto ticker symbol to act as a secondary price
+	.msgFormat <string> : the message posted in response to the command
+	.parseMode <string> : parse mode of the message
 	.
 
 
 user:%userID:activechat <string> : the chat to which the commands will affect
 user:%userID:activePath <Path> : the user dialogue Path that has been started, but not fully traversed
+user:%userID:banLists <SET> : names of the ban lists the user owns
+banList:%ownerID:%name:users <MAP> : IDs of users on the ban list to the reason they were banned
+banList:%ownerID:%name:chats <SET> : IDs of chats subscribed to the ban list
+chat:%chatID:banLists <SET> : "ownerID:name" of each ban list the chat subscribes to
 user:%userID:chats <SET> : quick lookup to see what chats user is admin/owner of
 user:%user:info <tb.User> : user object for looking up user details
 */
@@ -62,19 +145,79 @@ You can control me by sending these commands:
 /switchchat - changes which chat beru is managing when a user is an owner/admin of multiple chats
 /addchat - shortcut to invite link to add beru to your chat
 /removechat - choose between currently managed chats to remove
+/clonechat - copies settings from one of your chats to another
 
 *Custom Chat Commands*
 /addcommand - adds a custom command and response 
+/addcommandpool - adds a custom command that responds randomly or with a sequence of messages
 /removecommand - removes a custom command
 /viewcommands - prints a list of custom commands
+/exportcommands - sends the custom commands as a file you can import elsewhere
+/importcommands - replaces the custom commands with the ones in an exported file
+/addautoresponder - replies to plain text matching a keyword, phrase or regex
+/removeautoresponder - removes an auto-responder
+/viewautoresponders - prints a list of auto-responders
 
 *Chat Features*
 /setwelcome - greets every # users with a welcome message on chat join
 /togglejoinmsg - toggles deletion of the notification posted when users join (supergroups only)
-/addwhitelistedbot - adds a bot (by username) to be allowed to join a chat
+/addwhitelistedbot - adds a bot (forwarded message, username or ID) to be allowed to join a chat
 /removewhitelistedbot - removes a bots ability to join a chat
+/viewblockedbots - lists bots that were removed from the chat so you can whitelist them
+/setblockedbotaction - chooses how bots that aren't whitelisted are removed and what notice is posted
 /setpricecommand - allow beru to notify chats of a token's price
 /setnewusermediarestriction - will delete all media posts by users newer then the time specified
+/setmediapolicy - chooses what kinds of posts are deleted while users are restricted
+/setcaptcha - mutes new users until they solve a challenge and kicks them if they don't
+/setflood - limits how many messages, repeats and media one user can send in a short time
+/setraid - locks the chat down when too many people join at once
+/setnightmode - stops members posting media and links, or anything, during quiet hours
+/setwarnings - chooses how many warnings lead to a mute, removal or ban
+/addfilters - deletes messages with banned words, phrases or regular expressions
+/removefilter - removes a banned word, phrase or regular expression
+/viewfilters - prints the banned words, phrases and regular expressions
+/addnamefilters - bans or mutes users whose name matches a pattern when they join or change it
+/removenamefilter - removes a name filter
+/viewnamefilters - prints the name filters
+/setimpersonation - bans or mutes users whose name looks like one of the admins'
+/setauditlog - posts every moderation action to a channel or group of your choice
+/viewauditlog - prints the most recent moderation actions
+/addbanlist - adds a ban list, anyone banned in one of its chats is banned from the rest
+/togglebanlist - subscribes the chat to one of your ban lists or unsubscribes it
+/viewbanlists - prints your ban lists and the chats subscribed to them
+/exportbanlist - sends a ban list as a file you can import elsewhere
+/importbanlist - adds the users in an exported file to a ban list
+/togglenativerestriction - toggles restricting new users through Telegram instead of deleting their media
+/allowdomains - lets new users link to domains such as your website
+/denydomains - deletes links to domains no matter who posts them
+/removedomain - removes a domain from the allowed or denied domains
+/viewdomains - prints the allowed and denied domains
+/toggleaddressguard - toggles deleting wallet and contract addresses posted by anyone other than admins
+/allowaddresses - adds official addresses that anyone can post and that are shown when others are deleted
+/removeaddress - removes an official address
+/viewaddresses - prints the official addresses
+
+*In Chat (anyone)*
+/report - privately tells the admins about the message it replies to, with an optional reason
+
+*In Chat Moderation (admins only, reply to a message or name a user)*
+/warn - warns a user, with an optional reason
+/unwarn - removes a user's most recent warning
+/warnings - lists a user's warnings
+/resetwarns - removes all of a user's warnings
+/ban - bans a user, with an optional reason
+/tban - bans a user for a while, like /tban 1d spam
+/kick - removes a user, they can join again
+/mute - mutes a user, forever or for a while like /mute 2h spam
+/unmute - lets a muted user talk again
+/unban - lets a banned user join again and takes them off the chat's ban lists
+/purge - deletes the message it replies to
+
+*Scheduled Messages*
+/addschedule - posts a message on an interval or cron schedule
+/viewschedules - prints a list of scheduled messages
+/pauseschedule - pauses or resumes a scheduled message
+/removeschedule - removes a scheduled message
 `
 
 
@@ -84,6 +227,8 @@ func main() {
 	gob.Register(Prompt{})
 	gob.Register(tb.User{})
 	gob.Register(tb.Chat{})
+	// response pools pick at random
+	rand.Seed(time.Now().UnixNano())
 
 	R = redis.NewClient(&redis.Options{
 		Addr:     "localhost:6379",
@@ -93,7 +238,7 @@ func main() {
 	var err error
 	B, err = tb.NewBot(tb.Settings{
 		Token:  os.Getenv("TELEBOT_SECRET"),
-		Poller: &tb.LongPoller{Timeout: 10 * time.Second},
+		Poller: tb.NewMiddlewarePoller(&tb.LongPoller{Timeout: 10 * time.Second}, moderatePolls),
 	})
 	if err != nil {
 		panic(err)
@@ -103,6 +248,17 @@ func main() {
 	for k, v := range BuiltinCommandRegistry {
 		B.Handle(k, v)
 	}
+	for k, v := range GroupCommandRegistry {
+		B.Handle(k, v)
+	}
+	B.Handle(&checklistButton, onChecklistCallback)
+	B.Handle(&whitelistBotButton, onWhitelistBotCallback)
+	B.Handle(&captchaButton, onCaptchaCallback)
+	B.Handle(&filterPageButton, onFilterPageCallback)
+	B.Handle(&undoButton, onUndoCallback)
+	B.Handle(&unlockButton, onUnlockCallback)
+	B.Handle(&reportButton, onReportCallback)
+	B.Handle(&nameReviewButton, onNameReviewCallback)
 
 	// Command: /start <PAYLOAD>
 	B.Handle("/start", func(m *tb.Message) {
@@ -127,28 +283,27 @@ func main() {
 		B.Send(m.Sender, helpGuide, tb.ParseMode(tb.ModeMarkdown))
 	})
 
-	// deletes message if posted while the restriction flag still exists
-	removeMsgIfDisallowed := func(m *tb.Message) {
-		restrictionUserKey := fmt.Sprintf("chat:%d:userRestricted:%d", m.Chat.ID, m.Sender.ID)
-		exists := R.Exists(restrictionUserKey).Val()
-		if exists == 1 {
-			B.Delete(m)
+	// files and media can be the answer to a prompt, such as
+	// /importcommands or /addcommandpool
+	answerActivePath := func(m *tb.Message) {
+		if p := getUsersActivePath(m.Sender.ID); p != nil {
+			step(m, p)
 		}
 	}
 
-	B.Handle(tb.OnPhoto, func(m *tb.Message) {
-		removeMsgIfDisallowed(m)
-	})
-
-	B.Handle(tb.OnVideo, func(m *tb.Message) {
-		removeMsgIfDisallowed(m)
-	})
-
+	for _, event := range ContentEvents {
+		B.Handle(event, func(m *tb.Message) {
+			if m.Private() {
+				answerActivePath(m)
+			} else {
+				moderate(m)
+			}
+		})
+	}
 
 	B.Handle(tb.OnText, func(m *tb.Message) {
-		matched, _ := regexp.Match(`^(?:http(s)?:\/\/)?[\w.-]+(?:\.[\w\.-]+)+[\w\-\._~:/?#[\]@!\$&'\(\)\*\+,;=.]+$`, []byte(m.Text))
-		if matched {
-			removeMsgIfDisallowed(m)
+		if moderate(m) {
+			return
 		}
 
 		if p := getUsersActivePath(m.Sender.ID); p != nil {
@@ -169,17 +324,28 @@ func main() {
 			}
 			key := fmt.Sprintf("chat:%d:commands", chat)
 			if commandText, err := R.HGet(key, commandName).Result(); err != redis.Nil {
-				t, _ := template.New("command").Parse(commandText)
-				by := bytes.Buffer{}
-				if err := t.Execute(&by, m); err != nil {
+				modesKey := fmt.Sprintf("chat:%d:commandParseModes", chat)
+				parseMode, _ := R.HGet(modesKey, commandName).Result()
+				if pool, ok := getResponsePool(chat, commandName); ok {
+					if err := sendResponsePool(dest, pool, m, parseMode); err != nil {
+						LogE.Printf("failed to send response pool for command %s in chat %d: %s", commandName, chat, err)
+					}
+				} else if text, err := renderTemplateFor("command", commandText, m, parseMode); err != nil {
 					LogE.Printf("failed to render template for command %s in chat %d", commandName, chat)
 					B.Send(dest, ErrorResponse)
 				} else {
-					B.Send(dest, by.String())
+					B.Send(dest, text, &tb.SendOptions{
+						ParseMode:   parseModeFor(parseMode),
+						ReplyMarkup: getCommandReplyMarkup(chat, commandName),
+					})
 				}
 			}
+			return
+		}
+		// plain text in a group can trigger the chat's auto-responders
+		if !m.Private() {
+			runAutoResponders(m, m.Chat.ID)
 		}
-
 	})
 
 	B.Handle("/admins", func(m *tb.Message) {
@@ -213,21 +379,12 @@ func main() {
 			LogE.Print(err)
 			return
 		}
+		parseMode, _ := R.HGet(key, "parseMode").Result()
 
 		token := getTokenInfo(slug)
 		price, converted, pct_price, pct_conversion := getTokenPrice(token.ID, conversion)
-		// these are all the possible tags a user can use in the message formatter
-		replacer := strings.NewReplacer(
-			"{{price}}", strconv.FormatFloat(price, 'f', 5, 64),
-			"{{ticker}}", token.Symbol,
-			"{{name}}", token.Name,
-			"{{slug}}", slug,
-			"{{conversion}}", strconv.FormatFloat(converted, 'f', 8, 64),
-			"{{price_pct_change}}", fmt.Sprintf("%+.1f%%", pct_price),
-			"{{conversion_pct_change}}", fmt.Sprintf("%+.1f%%", pct_conversion),
-		)
-		replaced := replacer.Replace(msgFormat)
-		B.Send(m.Chat, replaced)
+		replaced := formatPriceMessage(msgFormat, slug, token, price, converted, pct_price, pct_conversion)
+		B.Send(m.Chat, replaced, parseModeFor(parseMode))
 	})
 
 	B.Handle(tb.OnUserJoined, func(m *tb.Message) {
@@ -237,23 +394,37 @@ func main() {
 		if err != nil {
 			restrictionTime = 1
 		}
-		// set the user restriction flag with a time to live of whatever was specified in the channel config
-		restrictionUserKey := fmt.Sprintf("chat:%d:userRestricted:%d", m.Chat.ID, m.Sender.ID)
 		ttl := time.Duration(restrictionTime * 1e9)
-		err = R.Set(restrictionUserKey, 0, ttl).Err()
-
-		// kick bot if not whitelisted
-		k := fmt.Sprintf("chat:%d:botWhitelist", m.Chat.ID)
-		for _, u := range m.UsersJoined {
-			// we only need to lookup users that are bots
-			if !strings.HasSuffix(strings.ToLower(u.Username), "bot") {
-				continue
+		// telebot calls this once for each user that joined
+		u := joinedUser(m)
+		if u.IsBot {
+			// kick bot if not whitelisted
+			rememberBot(u)
+			if !isWhitelistedBot(m.Chat.ID, u) {
+				blockBot(m, u)
+			}
+		} else {
+			// users on one of the chat's ban lists don't get past the door
+			if rejectListedUser(m, u) {
+				return
+			}
+			// users with a name like the ones spammers use or like an admin's are banned or muted for review
+			if enforceNameFilters(m.Chat, u) || catchImpersonator(m.Chat, u) {
+				return
+			}
+			// newcomers to a locked down chat stay restricted until the lockdown ends
+			lockdown := detectRaid(m, u)
+			if lockdown > ttl {
+				ttl = lockdown
 			}
-			// for all bots, ban if not member or if whitelist was never set up
-			isMember, err := R.SIsMember(k, u.Username).Result()
-			if err != nil || !isMember {
-				B.Ban(m.Chat, &tb.ChatMember{User: &u, RestrictedUntil: tb.Forever()})
-				B.Send(m.Chat, "fuck ur bot")
+			// set the user restriction flag with a time to live of whatever was specified in the channel config,
+			// it stays set alongside a native restriction for the content telegram can't restrict
+			restrictionUserKey := fmt.Sprintf("chat:%d:userRestricted:%d", m.Chat.ID, u.ID)
+			err = R.Set(restrictionUserKey, 0, ttl).Err()
+			// a captcha mutes them completely, the native restriction
+			// is applied once they pass it
+			if !startCaptcha(m, u) && (nativeRestrictionEnabled(m.Chat.ID) || lockdown > 0) {
+				restrictNewUser(m.Chat, u, ttl)
 			}
 		}
 
@@ -261,12 +432,15 @@ func main() {
 		countKey := fmt.Sprintf("chat:%d:usersJoinedCount", m.Chat.ID)
 		limitKey := fmt.Sprintf("chat:%d:usersJoinedLimit", m.Chat.ID)
 		messageKey := fmt.Sprintf("chat:%d:usersJoinedMessage", m.Chat.ID)
+		parseModeKey := fmt.Sprintf("chat:%d:usersJoinedParseMode", m.Chat.ID)
 		usersJoined, _ := R.Incr(countKey).Result()
 		usersLimit, _ := R.Get(limitKey).Int64()
 		if usersJoined%usersLimit == 0 {
 			joinedMsg, _ := R.Get(messageKey).Result()
-			fmtMsg := strings.Replace(joinedMsg, "$username", m.Sender.Username, -1)
-			B.Send(m.Chat, fmtMsg)
+			parseMode, _ := R.Get(parseModeKey).Result()
+			username := escapeForParseMode(m.Sender.Username, parseMode)
+			fmtMsg := strings.Replace(joinedMsg, "$username", username, -1)
+			B.Send(m.Chat, fmtMsg, parseModeFor(parseMode))
 		}
 		// delete join notification if setting is set to on
 		deleteKey := fmt.Sprintf("chat:%d:deleteJoinNotification", m.Chat.ID)
@@ -305,6 +479,7 @@ func main() {
 
 	})
 
+	go runScheduler()
 	B.Start()
 
 	interrupt := make(chan os.Signal, 1)
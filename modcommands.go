@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// actions a moderation command can take that the undo button knows how to reverse
+const (
+	UndoBan    = "ban"
+	UndoMute   = "mute"
+	UndoUnmute = "unmute"
+)
+
+// how long the undo button under a moderation command's confirmation works for
+const undoWindow = 5 * time.Minute
+
+// telegram treats bans and mutes longer than this as permanent
+const maxRestrictionTime = 366 * 24 * time.Hour
+
+// how long the confirmation of a purge stays up
+const purgeNoticeTTL = 10 * time.Second
+
+// inline button that reverses a moderation command, what it reverses is
+// kept in redis under the confirmation message
+var undoButton = tb.InlineButton{Unique: "undo", Text: "Undo"}
+
+func undoKey(chatID int64, messageID int) string {
+	return fmt.Sprintf("chat:%d:undo:%d", chatID, messageID)
+}
+
+// reads durations like 30m, 2h, 1d or 1w
+func parseDuration(text string) (time.Duration, bool) {
+	units := map[byte]time.Duration{'m': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+	if len(text) < 2 {
+		return 0, false
+	}
+	unit, ok := units[text[len(text)-1]]
+	n, err := strconv.Atoi(text[:len(text)-1])
+	if !ok || err != nil || n <= 0 {
+		return 0, false
+	}
+	if time.Duration(n) > maxRestrictionTime/unit {
+		// too long for telegram, stop there rather than overflow
+		return maxRestrictionTime + unit, true
+	}
+	return time.Duration(n) * unit, true
+}
+
+// splits a leading duration off the arguments, the duration is 0 if there isn't one
+func splitDuration(args string) (time.Duration, string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return 0, ""
+	}
+	d, ok := parseDuration(strings.ToLower(fields[0]))
+	if !ok {
+		return 0, args
+	}
+	return d, strings.TrimSpace(strings.TrimPrefix(args, fields[0]))
+}
+
+// works out who the command is about, refusing admins and beru itself,
+// asking telegram so an admin who was demoted can be moderated straight away
+func moderationTarget(m *tb.Message, verb string) (*tb.User, string, bool) {
+	u, args, err := targetOf(m)
+	if err != nil {
+		B.Reply(m, fmt.Sprintf("Who should be %s? %s", verb, err))
+		return nil, "", false
+	}
+	if u.ID == B.Me.ID || isChatAdmin(m.Chat.ID, u.ID) {
+		B.Reply(m, "Admins can't be "+verb)
+		return nil, "", false
+	}
+	return u, args, true
+}
+
+// posts what was done with an undo button for the next few minutes,
+// no button is shown if undo is empty
+func confirmAction(m *tb.Message, text string, reason string, undo string, u *tb.User) {
+	if reason != "" {
+		text += ": " + reason
+	}
+	if undo == "" {
+		B.Send(m.Chat, text)
+		return
+	}
+	markup := &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{{undoButton}}}
+	sent, err := B.Send(m.Chat, text, markup)
+	if err != nil {
+		LogE.Printf("couldn't confirm %s of user %d in chat %d: %s", undo, u.ID, m.Chat.ID, err)
+		return
+	}
+	err = R.Set(undoKey(m.Chat.ID, sent.ID), fmt.Sprintf("%s:%d", undo, u.ID), undoWindow).Err()
+	if err != nil {
+		LogE.Printf("couldn't save undo for message %d in chat %d: %s", sent.ID, m.Chat.ID, err)
+	}
+	err = queueJob(Job{Type: JRemoveButtons, ChatID: m.Chat.ID, MessageID: sent.ID}, time.Now().Add(undoWindow))
+	if err != nil {
+		LogE.Printf("undo button on message %d in chat %d won't be removed: %s", sent.ID, m.Chat.ID, err)
+	}
+}
+
+func banCommand(m *tb.Message) {
+	u, reason, ok := moderationTarget(m, "banned")
+	if !ok {
+		return
+	}
+	if err := B.Ban(m.Chat, &tb.ChatMember{User: u, RestrictedUntil: tb.Forever()}); err != nil {
+		LogE.Printf("couldn't ban user %d from chat %d: %s", u.ID, m.Chat.ID, err)
+		B.Reply(m, "I couldn't ban them, make sure I'm an admin that can ban users")
+		return
+	}
+	audit(AuditEntry{ChatID: m.Chat.ID, Action: AuditBan, Reason: reason, Link: messageLink(m)}.by(m.Sender).against(u))
+	propagateBan(m.Chat, u, reason)
+	confirmAction(m, displayName(u)+" has been banned by "+displayName(m.Sender), reason, UndoBan, u)
+}
+
+// /tban followed by how long the ban lasts, like /tban 2d spam
+func tempBanCommand(m *tb.Message) {
+	u, args, ok := moderationTarget(m, "banned")
+	if !ok {
+		return
+	}
+	d, reason := splitDuration(args)
+	if d == 0 {
+		B.Reply(m, "How long should the ban last? Follow /tban with a time like 30m, 2h, 1d or 1w")
+		return
+	}
+	if d > maxRestrictionTime {
+		B.Reply(m, "Bans can last at most 366 days, use /ban to ban them for good")
+		return
+	}
+	until := time.Now().Add(d)
+	if err := B.Ban(m.Chat, &tb.ChatMember{User: u, RestrictedUntil: until.Unix()}); err != nil {
+		LogE.Printf("couldn't ban user %d from chat %d: %s", u.ID, m.Chat.ID, err)
+		B.Reply(m, "I couldn't ban them, make sure I'm an admin that can ban users")
+		return
+	}
+	text := fmt.Sprintf("%s has been banned by %s for %s", displayName(u), displayName(m.Sender), strings.Fields(args)[0])
+	audit(AuditEntry{ChatID: m.Chat.ID, Action: AuditBan, Reason: strings.TrimSpace("for " + args),
+		Link: messageLink(m)}.by(m.Sender).against(u))
+	confirmAction(m, text, reason, UndoBan, u)
+}
+
+// kicked users can join again, so there's nothing for an undo button to do
+func kickCommand(m *tb.Message) {
+	u, reason, ok := moderationTarget(m, "kicked")
+	if !ok {
+		return
+	}
+	if err := kickMember(m.Chat, u); err != nil {
+		LogE.Print(err)
+		B.Reply(m, "I couldn't kick them, make sure I'm an admin that can ban users")
+		return
+	}
+	audit(AuditEntry{ChatID: m.Chat.ID, Action: AuditKick, Reason: reason, Link: messageLink(m)}.by(m.Sender).against(u))
+	confirmAction(m, displayName(u)+" has been kicked by "+displayName(m.Sender), reason, "", u)
+}
+
+// /mute with an optional time, like /mute 2h spam, without one they stay muted
+func muteCommand(m *tb.Message) {
+	u, args, ok := moderationTarget(m, "muted")
+	if !ok {
+		return
+	}
+	d, reason := splitDuration(args)
+	if d > maxRestrictionTime {
+		B.Reply(m, "Mutes can last at most 366 days, use /mute without a time to mute them for good")
+		return
+	}
+	until := tb.Forever()
+	if d > 0 {
+		until = time.Now().Add(d).Unix()
+	}
+	if err := muteMember(m.Chat, u, until); err != nil {
+		LogE.Printf("couldn't mute user %d in chat %d: %s", u.ID, m.Chat.ID, err)
+		B.Reply(m, "I couldn't mute them, make sure I'm an admin that can restrict users")
+		return
+	}
+	text := displayName(u) + " has been muted by " + displayName(m.Sender)
+	entry := AuditEntry{ChatID: m.Chat.ID, Action: AuditMute, Reason: reason, Link: messageLink(m)}.by(m.Sender).against(u)
+	if d > 0 {
+		text += " for " + strings.Fields(args)[0]
+		entry.Reason = strings.TrimSpace("for " + args)
+	}
+	audit(entry)
+	confirmAction(m, text, reason, UndoMute, u)
+}
+
+func unmuteCommand(m *tb.Message) {
+	u, reason, ok := moderationTarget(m, "unmuted")
+	if !ok {
+		return
+	}
+	if err := unmuteMember(m.Chat.ID, u.ID); err != nil {
+		LogE.Print(err)
+		B.Reply(m, "I couldn't unmute them, make sure I'm an admin that can restrict users")
+		return
+	}
+	audit(AuditEntry{ChatID: m.Chat.ID, Action: AuditUnmute, Reason: reason, Link: messageLink(m)}.by(m.Sender).against(u))
+	confirmAction(m, displayName(u)+" has been unmuted by "+displayName(m.Sender), reason, UndoUnmute, u)
+}
+
+// deletes the message the command replies to along with the command itself
+func purgeCommand(m *tb.Message) {
+	if m.ReplyTo == nil {
+		B.Reply(m, "Reply to the message that should be deleted")
+		return
+	}
+	if err := B.Delete(m.ReplyTo); err != nil {
+		LogE.Printf("couldn't purge message %d in chat %d: %s", m.ReplyTo.ID, m.Chat.ID, err)
+		B.Reply(m, "I couldn't delete that message, make sure I'm an admin that can delete messages")
+		return
+	}
+	entry := AuditEntry{ChatID: m.Chat.ID, Action: AuditDelete, Reason: "purged", Link: messageLink(m.ReplyTo)}.by(m.Sender)
+	if m.ReplyTo.Sender != nil {
+		entry = entry.against(m.ReplyTo.Sender)
+	}
+	audit(entry)
+	B.Delete(m)
+	if sent, err := B.Send(m.Chat, "Message deleted by "+displayName(m.Sender)); err == nil {
+		deleteMessageLater(sent, purgeNoticeTTL)
+	}
+}
+
+// reverses the action confirmed in the message and returns the audit
+// log action for the reversal, the undo only works once
+func undoAction(chat *tb.Chat, action string, userID int) (string, error) {
+	u := &tb.User{ID: userID}
+	switch action {
+	case UndoBan:
+		if err := B.Unban(chat, u); err != nil {
+			return "", errors.Wrapf(err, "couldn't unban user %d from chat %d", userID, chat.ID)
+		}
+		propagateUnban(chat, u)
+		return AuditUnban, nil
+	case UndoMute:
+		return AuditUnmute, unmuteMember(chat.ID, userID)
+	case UndoUnmute:
+		return AuditMute, errors.Wrapf(muteMember(chat, u, tb.Forever()), "couldn't mute user %d in chat %d", userID, chat.ID)
+	}
+	return "", errors.Errorf("%s can't be undone", action)
+}
+
+func onUndoCallback(c *tb.Callback) {
+	if c.Message == nil {
+		B.Respond(c, &tb.CallbackResponse{})
+		return
+	}
+	chat := c.Message.Chat
+	if !isActiveAdmin(c.Sender.ID, chat.ID) || !isTelegramAdmin(chat.ID, c.Sender.ID) {
+		B.Respond(c, &tb.CallbackResponse{Text: "Only admins can undo this"})
+		return
+	}
+	key := undoKey(chat.ID, c.Message.ID)
+	data, err := R.Get(key).Result()
+	// the first admin to press it claims the undo
+	if err != nil || R.Del(key).Val() == 0 {
+		B.EditReplyMarkup(c.Message, nil)
+		B.Respond(c, &tb.CallbackResponse{Text: "This can't be undone anymore"})
+		return
+	}
+	parts := strings.SplitN(data, ":", 2)
+	userID, _ := strconv.Atoi(parts[len(parts)-1])
+	reversal, err := undoAction(chat, parts[0], userID)
+	if err != nil {
+		LogE.Print(err)
+		B.Respond(c, &tb.CallbackResponse{Text: ErrorResponse})
+		return
+	}
+	audit(AuditEntry{ChatID: chat.ID, Action: reversal, Reason: "undid a " + parts[0],
+		Link: messageLink(c.Message)}.by(c.Sender).against(knownUser(userID)))
+	B.Edit(c.Message, c.Message.Text+"\nUndone by "+displayName(c.Sender), &tb.ReplyMarkup{})
+	B.Respond(c, &tb.CallbackResponse{})
+}
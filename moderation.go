@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// the kinds of content a media policy can block for restricted users
+const (
+	ContentPhoto     = "Photos"
+	ContentVideo     = "Videos"
+	ContentDocument  = "Files"
+	ContentAnimation = "GIFs"
+	ContentSticker   = "Stickers"
+	ContentVoice     = "Voice Notes"
+	ContentAudio     = "Audio"
+	ContentVideoNote = "Video Notes"
+	ContentContact   = "Contacts"
+	ContentLocation  = "Locations"
+	ContentPoll      = "Polls"
+	ContentDice      = "Dice"
+	ContentGame      = "Games"
+	ContentForward   = "Forwards"
+	ContentLink      = "Links"
+)
+
+var ContentTypes = []string{
+	ContentPhoto, ContentVideo, ContentDocument, ContentAnimation,
+	ContentSticker, ContentVoice, ContentAudio, ContentVideoNote,
+	ContentContact, ContentLocation, ContentPoll, ContentDice,
+	ContentGame, ContentForward, ContentLink,
+}
+
+// what restricted users were blocked from posting before media policies existed
+var DefaultMediaPolicy = []string{ContentPhoto, ContentVideo, ContentLink}
+
+// every telebot event for a message a user can post to a chat, other
+// than text which has its own handler
+var ContentEvents = []string{
+	tb.OnPhoto, tb.OnVideo, tb.OnDocument, tb.OnAnimation, tb.OnSticker,
+	tb.OnVoice, tb.OnAudio, tb.OnVideoNote, tb.OnContact, tb.OnLocation,
+	tb.OnVenue, tb.OnDice, tb.OnGame,
+}
+
+// telebot only gives OnPoll handlers the poll and not the message it was
+// posted in, so messages with a poll are picked out before they're
+// dispatched, nothing else handles them so they're dropped afterwards
+func moderatePolls(upd *tb.Update) bool {
+	if m := upd.Message; m != nil && m.Poll != nil {
+		go moderate(m)
+		return false
+	}
+	return true
+}
+
+// lists the content types a message contains
+func contentTypesOf(m *tb.Message) []string {
+	types := []string{}
+	switch {
+	case m.Photo != nil:
+		types = append(types, ContentPhoto)
+	case m.Video != nil:
+		types = append(types, ContentVideo)
+	case m.Animation != nil:
+		types = append(types, ContentAnimation)
+	case m.Document != nil:
+		types = append(types, ContentDocument)
+	case m.Sticker != nil:
+		types = append(types, ContentSticker)
+	case m.Voice != nil:
+		types = append(types, ContentVoice)
+	case m.Audio != nil:
+		types = append(types, ContentAudio)
+	case m.VideoNote != nil:
+		types = append(types, ContentVideoNote)
+	case m.Contact != nil:
+		types = append(types, ContentContact)
+	case m.Location != nil, m.Venue != nil:
+		types = append(types, ContentLocation)
+	case m.Poll != nil:
+		types = append(types, ContentPoll)
+	case m.Dice != nil:
+		types = append(types, ContentDice)
+	case m.Game != nil:
+		types = append(types, ContentGame)
+	}
+	if m.IsForwarded() {
+		types = append(types, ContentForward)
+	}
+	// links to allowlisted domains are fine to post
+	if len(unapprovedDomains(m)) > 0 {
+		types = append(types, ContentLink)
+	}
+	return types
+}
+
+// the content types restricted users can't post in the chat
+func getMediaPolicy(chatID int64) []string {
+	key := fmt.Sprintf("chat:%d:mediaPolicy", chatID)
+	policy, err := R.SMembers(key).Result()
+	if err != nil || len(policy) == 0 {
+		return DefaultMediaPolicy
+	}
+	blocked := []string{}
+	for _, p := range policy {
+		if p != ChecklistNone {
+			blocked = append(blocked, p)
+		}
+	}
+	return blocked
+}
+
+// deletes the message if the sender is still restricted and it contains
+// content the chat's media policy blocks, returns whether it was deleted
+func removeMsgIfDisallowed(m *tb.Message) bool {
+	restrictionUserKey := fmt.Sprintf("chat:%d:userRestricted:%d", m.Chat.ID, m.Sender.ID)
+	if exists := R.Exists(restrictionUserKey).Val(); exists != 1 {
+		return false
+	}
+	blocked := getMediaPolicy(m.Chat.ID)
+	if inLockdown(m.Chat.ID) {
+		blocked = ContentTypes
+	}
+	for _, t := range contentTypesOf(m) {
+		for _, b := range blocked {
+			if t == b {
+				B.Delete(m)
+				audit(AuditEntry{ChatID: m.Chat.ID, Action: AuditDelete, Reason: fmt.Sprintf("new users can't post %s", t),
+					Link: messageLink(m)}.against(m.Sender))
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// whether newcomers are restricted by Telegram itself rather than
+// having their media deleted after it is posted
+func nativeRestrictionEnabled(chatID int64) bool {
+	enabled, err := R.Get(fmt.Sprintf("chat:%d:nativeRestriction", chatID)).Int64()
+	return err == nil && enabled != 0
+}
+
+// stops a newcomer from posting media or link previews until the restriction
+// time is up, returns false if beru couldn't restrict them so the caller can
+// fall back to deleting their posts
+func restrictNewUser(chat *tb.Chat, u *tb.User, ttl time.Duration) bool {
+	until := time.Now().Add(ttl)
+	rights := tb.Rights{CanSendMessages: true, CanSendPolls: true}
+	err := B.Restrict(chat, &tb.ChatMember{User: u, Rights: rights, RestrictedUntil: until.Unix()})
+	if err != nil {
+		LogW.Printf("couldn't restrict user %d in chat %d, falling back to deleting their media: %s", u.ID, chat.ID, err)
+		return false
+	}
+	// telegram treats restrictions shorter than 30 seconds as permanent,
+	// so the restriction is always lifted by a job as well
+	err = queueJob(Job{Type: JLiftRestriction, ChatID: chat.ID, UserID: u.ID}, until)
+	if err != nil {
+		LogE.Printf("restriction of user %d in chat %d won't be lifted early: %s", u.ID, chat.ID, err)
+	}
+	return true
+}
+
+// gives a newcomer back the media and preview rights restrictNewUser took,
+// leaving them alone if they've been muted or restricted for longer since
+func liftRestriction(j Job) error {
+	chat := &tb.Chat{ID: j.ChatID}
+	member, err := B.ChatMemberOf(chat, &tb.User{ID: j.UserID})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't get user %d in chat %d to lift their restriction", j.UserID, j.ChatID)
+	}
+	if member.Role != tb.Restricted || !member.CanSendMessages {
+		return nil
+	}
+	// a later restriction, such as one extended by a lockdown, queued its own job
+	if member.RestrictedUntil > time.Now().Add(schedulerTick).Unix() {
+		return nil
+	}
+	rights := member.Rights
+	rights.CanSendMedia = true
+	rights.CanSendOther = true
+	rights.CanAddPreviews = true
+	member = &tb.ChatMember{User: &tb.User{ID: j.UserID}, Rights: rights, RestrictedUntil: tb.Forever()}
+	err = B.Restrict(chat, member)
+	return errors.Wrapf(err, "couldn't lift restriction of user %d in chat %d", j.UserID, j.ChatID)
+}
+
+// stops the user from sending anything until the given unix time
+func muteMember(chat *tb.Chat, u *tb.User, until int64) error {
+	return B.Restrict(chat, &tb.ChatMember{User: u, Rights: tb.NoRights(), RestrictedUntil: until})
+}
+
+// gives the user back everything the chat's permissions allow
+func unmuteMember(chatID int64, userID int) error {
+	rights := tb.NoRestrictions()
+	rights.CanInviteUsers = true
+	member := &tb.ChatMember{User: &tb.User{ID: userID}, Rights: rights, RestrictedUntil: tb.Forever()}
+	err := B.Restrict(&tb.Chat{ID: chatID}, member)
+	return errors.Wrapf(err, "couldn't lift restriction of user %d in chat %d", userID, chatID)
+}
+
+// removes the user from the chat without stopping them from joining again,
+// telegram has no kick so they're banned and unbanned straight away
+// night mode and lockdowns both change the whole chat's permissions, so they
+// share the permissions the chat had before either started and the rights
+// are worked out from whichever are active
+func basePermissionsKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:basePermissions", chatID)
+}
+
+func lockdownSilencedKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:lockdownSilenced", chatID)
+}
+
+// saves the chat's permissions unless a restriction already did, returns
+// false if they couldn't be read so the chat is left alone
+func saveBasePermissions(chatID int64) bool {
+	if R.Exists(basePermissionsKey(chatID)).Val() == 1 {
+		return true
+	}
+	c, err := B.ChatByID(strconv.FormatInt(chatID, 10))
+	if err != nil || c.Permissions == nil {
+		LogW.Printf("couldn't read the permissions of chat %d: %v", chatID, err)
+		return false
+	}
+	R.SetNX(basePermissionsKey(chatID), EncodeRights(c.Permissions), 0)
+	return true
+}
+
+// sets the chat's permissions to its saved ones less whatever night mode
+// and a lockdown take away, once neither is active they're given back as
+// they were and forgotten
+func applyChatRestrictions(chatID int64) error {
+	data, err := R.Get(basePermissionsKey(chatID)).Bytes()
+	if err != nil {
+		// beru hasn't changed the chat's permissions
+		return nil
+	}
+	rights := DecodeRights(data)
+	restricted := false
+	if mode, err := R.Get(nightActiveKey(chatID)).Result(); err == nil {
+		rights, restricted = nightRights(rights, mode), true
+	}
+	if R.Exists(lockdownSilencedKey(chatID)).Val() == 1 {
+		rights, restricted = tb.Rights{}, true
+	}
+	if err := B.SetGroupPermissions(&tb.Chat{ID: chatID}, rights); err != nil {
+		return errors.Wrapf(err, "couldn't set the permissions of chat %d", chatID)
+	}
+	if !restricted {
+		R.Del(basePermissionsKey(chatID))
+	}
+	return nil
+}
+
+func kickMember(chat *tb.Chat, u *tb.User) error {
+	if err := B.Ban(chat, &tb.ChatMember{User: u, RestrictedUntil: tb.Forever()}); err != nil {
+		return errors.Wrapf(err, "couldn't kick user %d from chat %d", u.ID, chat.ID)
+	}
+	return errors.Wrapf(B.Unban(chat, u), "couldn't unban kicked user %d from chat %d", u.ID, chat.ID)
+}
+
+// runs every message posted to a group through the chat's filters,
+// returns true if the message was removed
+func moderate(m *tb.Message) bool {
+	if m.Private() || m.Sender == nil {
+		return false
+	}
+	rememberUser(m.Sender)
+	return removeMsgIfNameChanged(m) || removeMsgIfDenylisted(m) || removeMsgIfFiltered(m) ||
+		removeMsgIfUnapprovedAddress(m) || removeMsgIfDisallowed(m) || removeMsgIfNightMode(m) || removeMsgIfFlooding(m)
+}
+
+// receives the content types ticked on the checklist
+func setMediaPolicy(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	blocked := []interface{}{ChecklistNone}
+	if ms[0].Text != ChecklistNone {
+		blocked = []interface{}{}
+		for _, t := range splitChecklist(ms[0].Text) {
+			blocked = append(blocked, t)
+		}
+	}
+	key := fmt.Sprintf("chat:%d:mediaPolicy", chatID)
+	_, err = R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(key)
+		pipe.SAdd(key, blocked...)
+		return nil
+	})
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't save media policy for chat %d", chatID)
+	}
+	if ms[0].Text == ChecklistNone {
+		B.Send(sender, fmt.Sprintf("New users in %s can now post anything", chatTitle))
+	} else {
+		B.Send(sender, fmt.Sprintf("New users in %s can't post: %s", chatTitle, ms[0].Text))
+	}
+	return
+}
+
+func toggleNativeRestriction(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	key := fmt.Sprintf("chat:%d:nativeRestriction", chatID)
+	enabled, _ := R.Get(key).Int64()
+	enabled = enabled ^ 1
+	if err = R.Set(key, enabled, 0).Err(); err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't toggle native restriction for chat %d", chatID)
+	}
+	if enabled != 0 {
+		B.Send(sender, fmt.Sprintf("New users in %s will be restricted by Telegram from sending media and link previews, make sure I'm an admin that can ban users", chatTitle))
+	} else {
+		B.Send(sender, fmt.Sprintf("New users' media in %s will be deleted after it is posted", chatTitle))
+	}
+	return
+}
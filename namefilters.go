@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// built in checks a name filter can use instead of a word, phrase or regular expression
+const (
+	NameLink      = "Telegram Links"
+	NameDirection = "Direction Overrides"
+	NameEmoji     = "Emojis"
+)
+
+// what happens to a user whose name matches a name filter
+const (
+	NameBan    = "Ban"
+	NameReview = "Mute for Review"
+)
+
+var NameActionButtons = [][]string{{NameBan, NameReview}}
+
+// what an admin can do with a user muted for review
+const (
+	NameApprove = "Approve"
+	NameReject  = "Ban"
+)
+
+// how many emojis make a name suspicious when the filter doesn't say
+const defaultNameEmojis = 5
+
+// how long admins have to review a muted user before the buttons stop working,
+// the user stays muted until an admin unmutes them
+const nameReviewTTL = 7 * 24 * time.Hour
+
+// inline buttons sent to admins about a user muted for review,
+// their data is "chatID:userID:action"
+var nameReviewButton = tb.InlineButton{Unique: "namereview"}
+
+var telegramLinkPattern = regexp.MustCompile(`(?i)(\bt\.me\b|telegram\.(me|dog)|tg://|joinchat)`)
+
+// characters that flip the direction of the text after them, used to
+// make names read differently than they're written
+const directionOverrides = "\u202a\u202b\u202c\u202d\u202e\u2066\u2067\u2068\u2069"
+
+// name filters are stored by pattern, the built in checks by kind since
+// their pattern is only a setting
+func nameFilterField(f FilterRule) string {
+	switch f.Kind {
+	case NameLink, NameDirection, NameEmoji:
+		return f.Kind
+	}
+	return f.Pattern
+}
+
+func nameFilterString(f FilterRule) string {
+	switch f.Kind {
+	case NameLink, NameDirection:
+		return fmt.Sprintf("%s → %s", f.Kind, f.Action)
+	case NameEmoji:
+		return fmt.Sprintf("%s or more %s → %s", f.Pattern, strings.ToLower(f.Kind), f.Action)
+	}
+	return f.String()
+}
+
+// tries the filter against one part of a user's name
+func nameMatches(f FilterRule, name string) bool {
+	if name == "" {
+		return false
+	}
+	switch f.Kind {
+	case NameLink:
+		return telegramLinkPattern.MatchString(name)
+	case NameDirection:
+		return strings.ContainsAny(name, directionOverrides)
+	case NameEmoji:
+		limit, _ := strconv.Atoi(f.Pattern)
+		emojis := 0
+		for _, r := range name {
+			if unicode.Is(unicode.So, r) {
+				emojis++
+			}
+		}
+		return emojis >= limit
+	}
+	return f.matches(name, normalizeForFilter(name))
+}
+
+func getNameFilters(chatID int64) ([]FilterRule, error) {
+	data, err := R.HGetAll(fmt.Sprintf("chat:%d:nameFilters", chatID)).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't get name filters for chat %d", chatID)
+	}
+	rules := []FilterRule{}
+	for _, d := range data {
+		rules = append(rules, DecodeFilterRule([]byte(d)))
+	}
+	sort.Slice(rules, func(i, j int) bool { return nameFilterField(rules[i]) < nameFilterField(rules[j]) })
+	return rules, nil
+}
+
+// the first of the chat's name filters the user's first name, last name or
+// username matches, and a description of what matched
+func matchNameFilters(chatID int64, u *tb.User) (*FilterRule, string) {
+	rules, err := getNameFilters(chatID)
+	if err != nil {
+		LogE.Print(err)
+		return nil, ""
+	}
+	parts := []struct{ label, name string }{
+		{"first name", u.FirstName},
+		{"last name", u.LastName},
+		{"username", u.Username},
+	}
+	for i, f := range rules {
+		for _, p := range parts {
+			if nameMatches(f, p.name) {
+				return &rules[i], fmt.Sprintf("%s matched name filter %s", p.label, nameFilterField(f))
+			}
+		}
+	}
+	return nil, ""
+}
+
+// the user's names as last seen in the chat, to notice when they change them
+func nameFingerprint(u *tb.User) string {
+	return strings.Join([]string{u.FirstName, u.LastName, u.Username}, "\n")
+}
+
+// checks a user's name against the chat's name filters and bans or mutes
+// them if it matches, returns whether anything was done
+func enforceNameFilters(chat *tb.Chat, u *tb.User) bool {
+	R.HSet(fmt.Sprintf("chat:%d:memberNames", chat.ID), strconv.Itoa(u.ID), nameFingerprint(u))
+	f, reason := matchNameFilters(chat.ID, u)
+	if f == nil {
+		return false
+	}
+	LogI.Printf("user %d in chat %d: %s", u.ID, chat.ID, reason)
+	entry := AuditEntry{ChatID: chat.ID, Reason: reason}.against(u)
+	if f.Action == NameBan {
+		if err := B.Ban(chat, &tb.ChatMember{User: u, RestrictedUntil: tb.Forever()}); err != nil {
+			LogE.Printf("couldn't ban user %d from chat %d: %s", u.ID, chat.ID, err)
+			return false
+		}
+		entry.Action = AuditBan
+		audit(entry)
+		propagateBan(chat, u, reason)
+		return true
+	}
+	if err := muteMember(chat, u, tb.Forever()); err != nil {
+		LogE.Printf("couldn't mute user %d in chat %d: %s", u.ID, chat.ID, err)
+		return false
+	}
+	entry.Action, entry.Reason = AuditMute, reason+", waiting for review"
+	audit(entry)
+	requestNameReview(chat, u, reason)
+	return true
+}
+
+// asks the chat's admins whether a user muted by a name filter can stay
+func requestNameReview(chat *tb.Chat, u *tb.User, reason string) {
+	R.Set(fmt.Sprintf("chat:%d:nameReview:%d", chat.ID, u.ID), reason, nameReviewTTL)
+	admins, err := R.SMembers(fmt.Sprintf("chat:%d:activeAdmins", chat.ID)).Result()
+	if err != nil {
+		LogE.Printf("couldn't get admins to review user %d in chat %d: %s", u.ID, chat.ID, err)
+		return
+	}
+	title, _ := getChatTitle(int(chat.ID))
+	row := []tb.InlineButton{}
+	for _, action := range []string{NameApprove, NameReject} {
+		button := nameReviewButton
+		button.Text, button.Data = action, fmt.Sprintf("%d:%d:%s", chat.ID, u.ID, action)
+		row = append(row, button)
+	}
+	text := fmt.Sprintf("I muted %s (%d) in %s because their %s, should they stay?", displayName(u), u.ID, title, reason)
+	for _, a := range admins {
+		adminID, _ := strconv.Atoi(a)
+		B.Send(&tb.User{ID: adminID}, text, &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{row}})
+	}
+}
+
+// the first admin to press one of the buttons decides for all of them
+func onNameReviewCallback(c *tb.Callback) {
+	parts := strings.SplitN(c.Data, ":", 3)
+	if len(parts) != 3 {
+		B.Respond(c, &tb.CallbackResponse{})
+		return
+	}
+	chatID, _ := strconv.ParseInt(parts[0], 10, 64)
+	userID, _ := strconv.Atoi(parts[1])
+	action := parts[2]
+	if !isActiveAdmin(c.Sender.ID, chatID) {
+		B.Respond(c, &tb.CallbackResponse{Text: "You're no longer an admin of that chat"})
+		return
+	}
+	reviewKey := fmt.Sprintf("chat:%d:nameReview:%d", chatID, userID)
+	reason, err := R.Get(reviewKey).Result()
+	if err != nil || R.Del(reviewKey).Val() == 0 {
+		B.EditReplyMarkup(c.Message, nil)
+		B.Respond(c, &tb.CallbackResponse{Text: "This user has already been reviewed"})
+		return
+	}
+	chat := &tb.Chat{ID: chatID}
+	u := knownUser(userID)
+	entry := AuditEntry{ChatID: chatID, Reason: reason}.by(c.Sender).against(u)
+	if action == NameApprove {
+		err = unmuteMember(chatID, userID)
+		entry.Action = AuditUnmute
+	} else {
+		err = B.Ban(chat, &tb.ChatMember{User: u, RestrictedUntil: tb.Forever()})
+		entry.Action = AuditBan
+	}
+	if err != nil {
+		LogE.Print(errors.Wrapf(err, "couldn't %s user %d in chat %d after review", strings.ToLower(action), userID, chatID))
+		R.Set(reviewKey, reason, nameReviewTTL)
+		B.Respond(c, &tb.CallbackResponse{Text: ErrorResponse})
+		return
+	}
+	audit(entry)
+	if action == NameReject {
+		propagateBan(chat, u, reason)
+	}
+	B.Edit(c.Message, fmt.Sprintf("%s\n\n%s by %s", c.Message.Text, action, displayName(c.Sender)), &tb.ReplyMarkup{})
+	B.Respond(c, &tb.CallbackResponse{Text: "Done"})
+}
+
+// runs the name filters and impersonation check again when a member's name has changed since they
+// were last seen, returns whether the message was removed
+func removeMsgIfNameChanged(m *tb.Message) bool {
+	if isKnownAdmin(m.Chat.ID, m.Sender.ID) {
+		return false
+	}
+	namesKey := fmt.Sprintf("chat:%d:memberNames", m.Chat.ID)
+	seen, err := R.HGet(namesKey, strconv.Itoa(m.Sender.ID)).Result()
+	if err == redis.Nil {
+		// members from before beru joined are only checked once they change their name
+		R.HSet(namesKey, strconv.Itoa(m.Sender.ID), nameFingerprint(m.Sender))
+		return false
+	}
+	if err != nil || seen == nameFingerprint(m.Sender) {
+		return false
+	}
+	if !enforceNameFilters(m.Chat, m.Sender) && !catchImpersonator(m.Chat, m.Sender) {
+		return false
+	}
+	B.Delete(m)
+	return true
+}
+
+// receives the match kind, action and the patterns, one per line
+func addNameFilters(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	kind, action := ms[0].Text, ms[1].Text
+	if action != NameBan && action != NameReview {
+		B.Send(sender, fmt.Sprintf("No name filters were added, %s isn't an action", action))
+		return
+	}
+	rules := map[string]interface{}{}
+	switch kind {
+	case NameLink, NameDirection:
+		f := FilterRule{Kind: kind, Action: action}
+		rules[nameFilterField(f)] = EncodeFilterRule(&f)
+	case NameEmoji:
+		limit, err := strconv.Atoi(strings.TrimSpace(ms[2].Text))
+		if err != nil || limit <= 0 {
+			limit = defaultNameEmojis
+		}
+		f := FilterRule{Kind: kind, Pattern: strconv.Itoa(limit), Action: action}
+		rules[nameFilterField(f)] = EncodeFilterRule(&f)
+	case TriggerKeyword, TriggerPhrase, TriggerRegex:
+		for _, line := range strings.Split(ms[2].Text, "\n") {
+			pattern := strings.TrimSpace(line)
+			if pattern == "" {
+				continue
+			}
+			if kind == TriggerRegex {
+				if _, err := regexp.Compile(pattern); err != nil {
+					B.Send(sender, fmt.Sprintf("No name filters were added, %s isn't a valid regular expression: %s", pattern, err))
+					return nil
+				}
+			} else if normalizeForFilter(pattern) == "" {
+				B.Send(sender, fmt.Sprintf("No name filters were added, %s doesn't have any letters or numbers", pattern))
+				return nil
+			}
+			f := FilterRule{Kind: kind, Pattern: pattern, Action: action}
+			rules[nameFilterField(f)] = EncodeFilterRule(&f)
+		}
+	default:
+		B.Send(sender, fmt.Sprintf("No name filters were added, %s isn't a way to match", kind))
+		return
+	}
+	if len(rules) == 0 {
+		B.Send(sender, "No name filters were added, send one word, phrase or regular expression per line")
+		return
+	}
+	if err = R.HMSet(fmt.Sprintf("chat:%d:nameFilters", chatID), rules).Err(); err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't add name filters to chat %d", chatID)
+	}
+	B.Send(sender, fmt.Sprintf("Added %d name filters to %s, they're checked when users join or change their name. "+
+		"Make sure I'm an admin that can ban users", len(rules), chatTitle))
+	return
+}
+
+func removeNameFilter(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, _, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	removed, err := R.HDel(fmt.Sprintf("chat:%d:nameFilters", chatID), ms[0].Text).Result()
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't remove name filter from chat %d", chatID)
+	}
+	if removed == 0 {
+		B.Send(sender, ms[0].Text+" isn't one of the name filters")
+		return
+	}
+	forgetFilter(ms[0].Text)
+	B.Send(sender, ms[0].Text+" has been removed from the name filters")
+	return
+}
+
+func viewNameFilters(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	rules, err := getNameFilters(int64(chatID))
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return err
+	}
+	if len(rules) == 0 {
+		B.Send(sender, chatTitle+" doesn't have any name filters")
+		return
+	}
+	lines := []string{"Name filters for " + chatTitle}
+	for _, f := range rules {
+		lines = append(lines, nameFilterString(f))
+	}
+	B.Send(sender, strings.Join(lines, "\n"))
+	return
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// what members other than admins can't do during a chat's quiet hours
+const (
+	NightOff        = "Off"
+	NightMedia      = "Media and Links"
+	NightEverything = "Everything"
+)
+
+var NightModeButtons = [][]string{{NightMedia, NightEverything}, {NightOff}}
+
+// a chat's quiet hours, start and end are minutes after midnight in the chat's timezone
+type NightMode struct {
+	Mode     string
+	Start    int
+	End      int
+	Location *time.Location
+	// posted when quiet hours start and deleted when they end, empty for none
+	Notice string
+}
+
+// reads a time of day like 23:00 as minutes after midnight
+func parseClock(text string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(text))
+	if err != nil {
+		return 0, errors.Errorf("%s isn't a time like 23:00", text)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+func getNightMode(chatID int64) (NightMode, error) {
+	settings, err := R.HGetAll(fmt.Sprintf("chat:%d:nightMode", chatID)).Result()
+	if err != nil {
+		return NightMode{}, errors.Wrapf(err, "couldn't get night mode of chat %d", chatID)
+	}
+	n := NightMode{Mode: settings["mode"], Notice: settings["notice"]}
+	if n.Mode == "" {
+		n.Mode = NightOff
+	}
+	n.Start, _ = strconv.Atoi(settings["start"])
+	n.End, _ = strconv.Atoi(settings["end"])
+	if n.Location, err = time.LoadLocation(settings["timezone"]); err != nil {
+		n.Location = time.UTC
+	}
+	return n, nil
+}
+
+// whether the time falls within quiet hours, which can run past midnight
+func (n NightMode) activeAt(t time.Time) bool {
+	if n.Mode == NightOff || n.Start == n.End {
+		return false
+	}
+	local := t.In(n.Location)
+	minute := local.Hour()*60 + local.Minute()
+	if n.Start < n.End {
+		return minute >= n.Start && minute < n.End
+	}
+	return minute >= n.Start || minute < n.End
+}
+
+func nightActiveKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:nightActive", chatID)
+}
+
+func nightModeActive(chatID int64) bool {
+	return R.Exists(nightActiveKey(chatID)).Val() == 1
+}
+
+// takes away what members can't do during quiet hours and keeps the rest of
+// the chat's permissions
+func nightRights(current tb.Rights, mode string) tb.Rights {
+	current.CanSendMedia = false
+	current.CanSendPolls = false
+	current.CanSendOther = false
+	current.CanAddPreviews = false
+	if mode == NightEverything {
+		current.CanSendMessages = false
+	}
+	return current
+}
+
+// starts or ends quiet hours in every chat, called on each scheduler tick
+// so it picks up changes to the settings and survives restarts
+func runNightModes(now time.Time) {
+	chats, err := R.SMembers("beru:chats").Result()
+	if err != nil {
+		LogE.Printf("couldn't get chats to run night modes: %s", err)
+		return
+	}
+	for _, c := range chats {
+		chatID, _ := strconv.ParseInt(c, 10, 64)
+		n, err := getNightMode(chatID)
+		if err != nil {
+			LogE.Print(err)
+			continue
+		}
+		active := nightModeActive(chatID)
+		if want := n.activeAt(now); want && !active {
+			startNightMode(chatID, n)
+		} else if !want && active {
+			endNightMode(chatID)
+		}
+	}
+}
+
+func startNightMode(chatID int64, n NightMode) {
+	// claims the start so only one instance restricts the chat
+	if ok, _ := R.SetNX(nightActiveKey(chatID), n.Mode, 0).Result(); !ok {
+		return
+	}
+	// without the chat's permissions there's nothing to give back later,
+	// so try again on the next tick
+	if !saveBasePermissions(chatID) {
+		R.Del(nightActiveKey(chatID))
+		return
+	}
+	chat := &tb.Chat{ID: chatID}
+	if err := applyChatRestrictions(chatID); err != nil {
+		LogE.Printf("couldn't start night mode in chat %d: %s", chatID, err)
+	}
+	if n.Notice != "" {
+		if sent, err := B.Send(chat, n.Notice); err == nil {
+			R.Set(fmt.Sprintf("chat:%d:nightNotice", chatID), sent.ID, 0)
+		}
+	}
+	LogI.Printf("started night mode in chat %d", chatID)
+	audit(AuditEntry{ChatID: chatID, Action: AuditNightStart, Reason: n.Mode})
+}
+
+// gives the chat back the permissions it had before quiet hours, unless
+// it's still silenced by a lockdown
+func endNightMode(chatID int64) {
+	if R.Del(nightActiveKey(chatID)).Val() == 0 {
+		return
+	}
+	chat := &tb.Chat{ID: chatID}
+	if err := applyChatRestrictions(chatID); err != nil {
+		LogE.Printf("couldn't restore permissions of chat %d after night mode: %s", chatID, err)
+	}
+	noticeKey := fmt.Sprintf("chat:%d:nightNotice", chatID)
+	if id, err := R.Get(noticeKey).Int(); err == nil {
+		B.Delete(&tb.Message{ID: id, Chat: chat})
+		R.Del(noticeKey)
+	}
+	LogI.Printf("ended night mode in chat %d", chatID)
+	audit(AuditEntry{ChatID: chatID, Action: AuditNightEnd})
+}
+
+// telegram can't stop members posting links as text, so during quiet hours
+// beru deletes them, returns whether the message was deleted
+func removeMsgIfNightMode(m *tb.Message) bool {
+	mode, err := R.Get(nightActiveKey(m.Chat.ID)).Result()
+	if err != nil || mode != NightMedia || isKnownAdmin(m.Chat.ID, m.Sender.ID) {
+		return false
+	}
+	if len(unapprovedDomains(m)) == 0 {
+		return false
+	}
+	B.Delete(m)
+	audit(AuditEntry{ChatID: m.Chat.ID, Action: AuditDelete, Reason: "link during night mode",
+		Link: messageLink(m)}.against(m.Sender))
+	return true
+}
+
+// receives what's restricted, when quiet hours start and end, the timezone and the notice
+func setNightMode(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	mode := ms[0].Text
+	switch mode {
+	case NightOff, NightMedia, NightEverything:
+	default:
+		B.Send(sender, fmt.Sprintf("Night mode wasn't saved, %s isn't something I can restrict", mode))
+		return
+	}
+	start, err := parseClock(ms[1].Text)
+	if err != nil {
+		B.Send(sender, fmt.Sprintf("Night mode wasn't saved, %s", err))
+		return nil
+	}
+	end, err := parseClock(ms[2].Text)
+	if err != nil {
+		B.Send(sender, fmt.Sprintf("Night mode wasn't saved, %s", err))
+		return nil
+	}
+	timezone := strings.TrimSpace(ms[3].Text)
+	if _, err := time.LoadLocation(timezone); err != nil {
+		B.Send(sender, fmt.Sprintf("Night mode wasn't saved, %s isn't a timezone like Europe/London", timezone))
+		return nil
+	}
+	notice := ms[4].Text
+	if notice == NoNotice {
+		notice = ""
+	}
+	err = R.HMSet(fmt.Sprintf("chat:%d:nightMode", chatID), map[string]interface{}{
+		"mode":     mode,
+		"start":    start,
+		"end":      end,
+		"timezone": timezone,
+		"notice":   notice,
+	}).Err()
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't save night mode for chat %d", chatID)
+	}
+	if mode == NightOff {
+		endNightMode(int64(chatID))
+		B.Send(sender, "Night mode has been turned off for "+chatTitle)
+		return
+	}
+	B.Send(sender, fmt.Sprintf("From %s to %s (%s) members of %s won't be able to post %s. "+
+		"Make sure I'm an admin that can ban users and delete messages", formatClock(start), formatClock(end),
+		timezone, chatTitle, strings.ToLower(mode)))
+	return
+}
@@ -3,6 +3,8 @@ package main
 import (
 	tb "gopkg.in/tucnak/telebot.v2"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,6 +21,8 @@ type Path struct {
 	Consumer ConsumerType
 	// path is only available to chat owner
 	OwnerOnly bool
+	// options ticked so far on the current checklist prompt
+	Checked []string
 }
 
 type Processor func(*tb.Message, *Prompt) *tb.Message
@@ -41,6 +45,19 @@ type Prompt struct {
 	UserResponse *tb.Message
 	// processes UserResponse before being fed to next prompt
 	ProcessResponse string
+	// optional options the user can tick before pressing done, the
+	// response is the ticked options joined by a comma
+	Checklist []string
+	// options already ticked when the checklist is sent
+	Checked []string
+	// when the user answers with RewindOn the path goes back to the
+	// prompt at index RewindTo, discarding the answers given since
+	// (only for paths where each prompt before it gets one answer)
+	RewindOn string
+	RewindTo int
+	// keeps collecting answers to this prompt until the user answers
+	// with RepeatUntil, which is kept as the last of the answers
+	RepeatUntil string
 }
 
 // standard prompt when an error occurs
@@ -54,6 +71,13 @@ func wrapPathBegin(p Path) func(m *tb.Message) {
 	}
 }
 
+// response sent by a checklist prompt when nothing was ticked
+const ChecklistNone = "none"
+
+// callback button shared by every checklist prompt, the data
+// is the index of the toggled option or "done"
+var checklistButton = tb.InlineButton{Unique: "checklist"}
+
 func getUsersActivePath(userID int) *Path {
 	key := fmt.Sprintf("user:%d:activePath", userID)
 	pathData, err := R.Get(key).Result()
@@ -100,10 +124,20 @@ func begin(m *tb.Message, p Path) {
 
 func step(m *tb.Message, p *Path) error {
 	key := fmt.Sprintf("user:%d:activePath", m.Sender.ID)
-	// if the incoming message has text append it to the list of responses.
-	if m.Text != "" {
+	// if the incoming message has text or media append it to the list of responses.
+	if m.Text != "" || m.Document != nil || m.Photo != nil || m.Animation != nil || m.Sticker != nil {
 		p.Responses = append(p.Responses, m)
 	}
+	if p.Index > 0 {
+		prev := p.Prompts[p.Index-1]
+		if prev.RewindOn != "" && m.Text == prev.RewindOn {
+			p.Index = prev.RewindTo
+			p.Responses = p.Responses[:prev.RewindTo]
+		} else if prev.RepeatUntil != "" && m.Text != prev.RepeatUntil {
+			// wait for more answers to the same prompt
+			return saveUsersActivePath(m.Sender.ID, p)
+		}
+	}
 	// if all of the prompts have been sent to the user call the function
 	// at the end of the path, and pass in the responses joined by a semicolon
 	if p.Index == len(p.Prompts) {
@@ -144,12 +178,112 @@ func step(m *tb.Message, p *Path) error {
 			OneTimeKeyboard:     true,
 		}
 	}
+	if len(pr.Checklist) > 0 {
+		p.Checked = append([]string{}, pr.Checked...)
+		pr.Reply = tb.ReplyMarkup{
+			InlineKeyboard: getChecklistKeyboard(pr.Checklist, p.Checked),
+		}
+	}
 	if m.Private() {
 		B.Send(m.Sender, pr.Text, &pr.Reply)
 	} else {
 		B.Send(m.Chat, pr.Text, &pr.Reply)
 	}
 	p.Index += 1
-	R.Set(key, EncodePath(p), time.Minute)
+	saveUsersActivePath(m.Sender.ID, p)
 	return nil
 }
+
+// updates the saved state data of a path with a reset TTL
+func saveUsersActivePath(userID int, p *Path) error {
+	key := fmt.Sprintf("user:%d:activePath", userID)
+	return R.Set(key, EncodePath(p), time.Minute).Err()
+}
+
+// returns a handler for a reply button that answers the user's active
+// path with msg rather than the text shown on the button
+func interceptPathText(msg string) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		if p := getUsersActivePath(m.Sender.ID); p != nil {
+			m.Text = msg
+			step(m, p)
+		}
+	}
+}
+
+// the options ticked in a checklist response
+func splitChecklist(response string) []string {
+	if response == ChecklistNone {
+		return []string{}
+	}
+	return strings.Split(response, ",")
+}
+
+func getChecklistKeyboard(options []string, checked []string) [][]tb.InlineButton {
+	keys := [][]tb.InlineButton{}
+	for i, o := range options {
+		box := "⬜"
+		for _, c := range checked {
+			if c == o {
+				box = "✅"
+			}
+		}
+		keys = append(keys, []tb.InlineButton{{
+			Unique: checklistButton.Unique,
+			Text:   fmt.Sprintf("%s %s", box, o),
+			Data:   strconv.Itoa(i),
+		}})
+	}
+	keys = append(keys, []tb.InlineButton{{
+		Unique: checklistButton.Unique,
+		Text:   "Done",
+		Data:   "done",
+	}})
+	return keys
+}
+
+// toggles an option of the checklist prompt the user is answering, or
+// answers the prompt with the ticked options once they press done
+func onChecklistCallback(c *tb.Callback) {
+	p := getUsersActivePath(c.Sender.ID)
+	if p == nil || p.Index == 0 || len(p.Prompts[p.Index-1].Checklist) == 0 {
+		B.Respond(c, &tb.CallbackResponse{Text: "This checklist has expired"})
+		return
+	}
+	options := p.Prompts[p.Index-1].Checklist
+	if c.Data == "done" {
+		B.Respond(c)
+		B.EditReplyMarkup(c.Message, nil)
+		// answer the path as the user rather than the bot that sent the checklist
+		m := *c.Message
+		m.Sender = c.Sender
+		m.Text = strings.Join(p.Checked, ",")
+		if m.Text == "" {
+			m.Text = ChecklistNone
+		}
+		step(&m, p)
+		return
+	}
+	i, err := strconv.Atoi(c.Data)
+	if err != nil || i < 0 || i >= len(options) {
+		B.Respond(c)
+		return
+	}
+	checked := []string{}
+	for _, o := range p.Checked {
+		if o != options[i] {
+			checked = append(checked, o)
+		}
+	}
+	if len(checked) == len(p.Checked) {
+		checked = append(checked, options[i])
+	}
+	p.Checked = checked
+	if err := saveUsersActivePath(c.Sender.ID, p); err != nil {
+		LogE.Printf("unable to save active path for user %d %s", c.Sender.ID, err)
+	}
+	B.Respond(c)
+	B.EditReplyMarkup(c.Message, &tb.ReplyMarkup{
+		InlineKeyboard: getChecklistKeyboard(options, p.Checked),
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// how a command picks from its pool of responses
+const (
+	PoolRandom   = "Random"
+	PoolSequence = "Sequence"
+)
+
+// the longest a sequence will wait between messages
+const maxPoolDelay = 30
+
+// answer that ends the list of responses in the pool path
+const PoolDone = "Done"
+
+// one of the messages a command can respond with, either
+// text or a photo, GIF or sticker with an optional caption
+type PoolResponse struct {
+	Text        string `json:"text,omitempty"`
+	PhotoID     string `json:"photo_id,omitempty"`
+	AnimationID string `json:"animation_id,omitempty"`
+	StickerID   string `json:"sticker_id,omitempty"`
+	// relative chance of being picked from a random pool
+	Weight int `json:"weight,omitempty"`
+}
+
+// the responses of a command that replies with a random pick
+// or with every response in order
+type ResponsePool struct {
+	Mode      string         `json:"mode"`
+	Responses []PoolResponse `json:"responses"`
+	// seconds to wait between the messages of a sequence
+	Delay int `json:"delay,omitempty"`
+}
+
+func (p ResponsePool) String() string {
+	return fmt.Sprintf("(%s pool of %d responses)", strings.ToLower(p.Mode), len(p.Responses))
+}
+
+// picks a response with a chance proportional to its weight
+func (p ResponsePool) pick() PoolResponse {
+	total := 0
+	for _, r := range p.Responses {
+		total += r.Weight
+	}
+	n := rand.Intn(total)
+	for _, r := range p.Responses {
+		if n < r.Weight {
+			return r
+		}
+		n -= r.Weight
+	}
+	return p.Responses[len(p.Responses)-1]
+}
+
+var poolWeightRx = regexp.MustCompile(`^\s*(\d+)\s*\|\s*`)
+
+// builds a pool response out of a message the admin sent, text
+// and captions can start with a weight such as "5|gm fren"
+func newPoolResponse(m *tb.Message) (PoolResponse, error) {
+	r := PoolResponse{Text: m.Text, Weight: 1}
+	switch {
+	case m.Photo != nil:
+		r.PhotoID, r.Text = m.Photo.FileID, m.Caption
+	case m.Animation != nil:
+		r.AnimationID, r.Text = m.Animation.FileID, m.Caption
+	case m.Sticker != nil:
+		r.StickerID = m.Sticker.FileID
+	case m.Text == "":
+		return r, errors.New("responses can only be text, photos, GIFs or stickers")
+	}
+	if match := poolWeightRx.FindStringSubmatch(r.Text); match != nil {
+		r.Weight, _ = strconv.Atoi(match[1])
+		r.Text = r.Text[len(match[0]):]
+	}
+	if r.Weight <= 0 {
+		return r, errors.New("weights have to be more than 0")
+	}
+	return r, nil
+}
+
+func getResponsePool(chatID int, name string) (ResponsePool, bool) {
+	key := fmt.Sprintf("chat:%d:commandPools", chatID)
+	data, err := R.HGet(key, name).Bytes()
+	if err != nil {
+		return ResponsePool{}, false
+	}
+	return DecodeResponsePool(data), true
+}
+
+func sendPoolResponse(dest tb.Recipient, r PoolResponse, m *tb.Message, mode string) error {
+	text, err := renderTemplateFor("pool", r.Text, m, mode)
+	if err != nil {
+		return err
+	}
+	switch {
+	case r.PhotoID != "":
+		_, err = B.Send(dest, &tb.Photo{File: tb.File{FileID: r.PhotoID}, Caption: text}, parseModeFor(mode))
+	case r.AnimationID != "":
+		_, err = B.Send(dest, &tb.Animation{File: tb.File{FileID: r.AnimationID}, Caption: text}, parseModeFor(mode))
+	case r.StickerID != "":
+		_, err = B.Send(dest, &tb.Sticker{File: tb.File{FileID: r.StickerID}})
+	default:
+		_, err = B.Send(dest, text, parseModeFor(mode))
+	}
+	return err
+}
+
+// responds to a command with one pick from a random pool or every
+// message of a sequence
+func sendResponsePool(dest tb.Recipient, p ResponsePool, m *tb.Message, mode string) error {
+	if len(p.Responses) == 0 {
+		return errors.New("response pool is empty")
+	}
+	if p.Mode == PoolRandom {
+		return sendPoolResponse(dest, p.pick(), m, mode)
+	}
+	for i, r := range p.Responses {
+		if i > 0 && p.Delay > 0 {
+			time.Sleep(time.Duration(p.Delay) * time.Second)
+		}
+		if err := sendPoolResponse(dest, r, m, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receives the command name, pool mode, parse mode, each response followed by done, and the delay
+func addCommandPool(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	if len(ms) < 6 {
+		B.Send(sender, "you need to add at least one response to the pool")
+		return
+	}
+	commandName := ms[0].Text
+	if !strings.HasPrefix(commandName, "/") {
+		commandName = "/" + commandName
+	}
+	pool := ResponsePool{Mode: ms[1].Text}
+	if pool.Mode != PoolRandom && pool.Mode != PoolSequence {
+		B.Send(sender, fmt.Sprintf("The pool needs to be either %s or %s", PoolRandom, PoolSequence))
+		return
+	}
+	parseMode := ms[2].Text
+	for _, m := range ms[3 : len(ms)-2] {
+		r, err := newPoolResponse(m)
+		if err != nil {
+			B.Send(sender, fmt.Sprintf("command %s was not saved, %s", commandName, err))
+			return nil
+		}
+		if err := validateFormatting(r.Text, parseMode); err != nil {
+			B.Send(sender, fmt.Sprintf("command %s was not saved, a response isn't valid %s: %s", commandName, parseMode, err))
+			return nil
+		}
+		pool.Responses = append(pool.Responses, r)
+	}
+	delay := ms[len(ms)-1].Text
+	if pool.Delay, err = strconv.Atoi(delay); err != nil || pool.Delay < 0 || pool.Delay > maxPoolDelay {
+		B.Send(sender, fmt.Sprintf("The delay needs to be a number of seconds up to %d, \"%s\" is not", maxPoolDelay, delay))
+		return nil
+	}
+	if len(pool.Responses) == 0 {
+		B.Send(sender, "you need to add at least one response to the pool")
+		return
+	}
+	if err = registerResponsePool(sender.ID, commandName, pool, parseMode); err != nil {
+		msg := fmt.Sprintf("error while trying to add command %s", commandName)
+		B.Send(sender, msg)
+		return errors.Wrapf(err, msg)
+	}
+	B.Send(sender, fmt.Sprintf("added/updated command %s %s", commandName, pool))
+	return
+}
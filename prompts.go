@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 
 	tb "gopkg.in/tucnak/telebot.v2"
 )
@@ -13,11 +15,25 @@ import (
 type GeneratorType string
 
 const (
-	GSwitchChat         GeneratorType = "SwitchChatGenerator"
-	GAddAdmin           GeneratorType = "AddAdminGenerator"
-	GRemoveAdmin        GeneratorType = "RemoveAdminGenerator"
-	GRemoveChat         GeneratorType = "RemoveChatGenerator"
-	GRemoveBotGenerator GeneratorType = "RemoveBotGenerator"
+	GSwitchChat          GeneratorType = "SwitchChatGenerator"
+	GAddAdmin            GeneratorType = "AddAdminGenerator"
+	GRemoveAdmin         GeneratorType = "RemoveAdminGenerator"
+	GRemoveChat          GeneratorType = "RemoveChatGenerator"
+	GRemoveBotGenerator  GeneratorType = "RemoveBotGenerator"
+	GRemoveAutoResponder GeneratorType = "RemoveAutoResponderGenerator"
+	GImportCommands      GeneratorType = "ImportCommandsGenerator"
+	GCloneSource         GeneratorType = "CloneSourceGenerator"
+	GCloneTarget         GeneratorType = "CloneTargetGenerator"
+	GPreviewCommand      GeneratorType = "PreviewCommandGenerator"
+	GPreviewWelcome      GeneratorType = "PreviewWelcomeGenerator"
+	GPreviewPrice        GeneratorType = "PreviewPriceGenerator"
+	GPickSchedule        GeneratorType = "PickScheduleGenerator"
+	GMediaPolicy         GeneratorType = "MediaPolicyGenerator"
+	GRemoveDomain        GeneratorType = "RemoveDomainGenerator"
+	GRemoveAddress       GeneratorType = "RemoveAddressGenerator"
+	GRemoveFilter        GeneratorType = "RemoveFilterGenerator"
+	GRemoveNameFilter    GeneratorType = "RemoveNameFilterGenerator"
+	GPickBanList         GeneratorType = "PickBanListGenerator"
 )
 
 // a generator takes a message and a prompt, uses the messaage
@@ -25,12 +41,32 @@ const (
 // Text and or Reply fields.
 type Generator func(*tb.Message, *Prompt)
 
-var GeneratorRegistry = map[GeneratorType]Generator{
-	GSwitchChat:         SwitchChatGenerator,
-	GRemoveChat:         RemoveChatGenerator,
-	GAddAdmin:           AddAdminGenerator,
-	GRemoveAdmin:        RemoveAdminGenerator,
-	GRemoveBotGenerator: RemoveBotGenerator,
+// filled in by init since generators that answer the active path refer
+// back to step, which looks generators up in this registry
+var GeneratorRegistry map[GeneratorType]Generator
+
+func init() {
+	GeneratorRegistry = map[GeneratorType]Generator{
+		GSwitchChat:          SwitchChatGenerator,
+		GRemoveChat:          RemoveChatGenerator,
+		GAddAdmin:            AddAdminGenerator,
+		GRemoveAdmin:         RemoveAdminGenerator,
+		GRemoveBotGenerator:  RemoveBotGenerator,
+		GRemoveAutoResponder: RemoveAutoResponderGenerator,
+		GImportCommands:      ImportCommandsGenerator,
+		GCloneSource:         CloneSourceGenerator,
+		GCloneTarget:         CloneTargetGenerator,
+		GPreviewCommand:      PreviewCommandGenerator,
+		GPreviewWelcome:      PreviewWelcomeGenerator,
+		GPreviewPrice:        PreviewPriceGenerator,
+		GPickSchedule:        PickScheduleGenerator,
+		GMediaPolicy:         MediaPolicyGenerator,
+		GRemoveDomain:        RemoveDomainGenerator,
+		GRemoveAddress:       RemoveAddressGenerator,
+		GRemoveFilter:        RemoveFilterGenerator,
+		GRemoveNameFilter:    RemoveNameFilterGenerator,
+		GPickBanList:         PickBanListGenerator,
+	}
 }
 
 func SwitchChatGenerator(m *tb.Message, pr *Prompt) {
@@ -41,6 +77,116 @@ func RemoveChatGenerator(m *tb.Message, pr *Prompt) {
 	ChatSubGenerator(m, pr, CRemoveChat)
 }
 
+func CloneSourceGenerator(m *tb.Message, pr *Prompt) {
+	ChatSubGenerator(m, pr, "")
+}
+
+// the previous answer is the source chat, which can't also be the target
+func CloneTargetGenerator(m *tb.Message, pr *Prompt) {
+	sourceID, _ := strconv.Atoi(m.Text)
+	ChatSubGenerator(m, pr, "", sourceID)
+}
+
+// ticks the content types the chat currently blocks
+func MediaPolicyGenerator(m *tb.Message, pr *Prompt) {
+	chatID, _, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		LogE.Printf("unable to get activeChat: %s", err)
+	}
+	pr.Checklist = ContentTypes
+	pr.Checked = getMediaPolicy(int64(chatID))
+}
+
+func RemoveDomainGenerator(m *tb.Message, pr *Prompt) {
+	chatID, _, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		LogE.Printf("unable to get activeChat: %s", err)
+	}
+	domains := append(getDomainList(int64(chatID), DomainAllowlist), getDomainList(int64(chatID), DomainDenylist)...)
+	if len(domains) == 0 {
+		pr.Text = "You don't have any allowed or denied domains to remove!"
+		return
+	}
+	pr.Reply = tb.ReplyMarkup{
+		ReplyKeyboard:       getReplyKeyboardForLabels(domains),
+		ResizeReplyKeyboard: true,
+		OneTimeKeyboard:     true,
+	}
+}
+
+func RemoveNameFilterGenerator(m *tb.Message, pr *Prompt) {
+	chatID, _, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		LogE.Printf("unable to get activeChat: %s", err)
+	}
+	rules, err := getNameFilters(int64(chatID))
+	if err != nil {
+		LogE.Print(err)
+		*pr = ErrorPrompt
+		return
+	}
+	if len(rules) == 0 {
+		pr.Text = "You don't have any name filters to remove!"
+		return
+	}
+	fields := []string{}
+	for _, f := range rules {
+		fields = append(fields, nameFilterField(f))
+	}
+	pr.Reply = tb.ReplyMarkup{
+		ReplyKeyboard:       getReplyKeyboardForLabels(fields),
+		ResizeReplyKeyboard: true,
+		OneTimeKeyboard:     true,
+	}
+}
+
+func RemoveAddressGenerator(m *tb.Message, pr *Prompt) {
+	chatID, _, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		LogE.Printf("unable to get activeChat: %s", err)
+	}
+	addresses := []string{}
+	for address := range getAllowedAddresses(int64(chatID)) {
+		addresses = append(addresses, address)
+	}
+	if len(addresses) == 0 {
+		pr.Text = "You don't have any official addresses to remove!"
+		return
+	}
+	sort.Strings(addresses)
+	pr.Reply = tb.ReplyMarkup{
+		ReplyKeyboard:       getReplyKeyboardForLabels(addresses),
+		ResizeReplyKeyboard: true,
+		OneTimeKeyboard:     true,
+	}
+}
+
+func RemoveFilterGenerator(m *tb.Message, pr *Prompt) {
+	chatID, _, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		LogE.Printf("unable to get activeChat: %s", err)
+	}
+	rules, err := getFilterRules(int64(chatID))
+	if err != nil {
+		LogE.Print(err)
+		*pr = ErrorPrompt
+		return
+	}
+	if len(rules) == 0 {
+		pr.Text = "You don't have any filters to remove!"
+		return
+	}
+	patterns := []string{}
+	for _, f := range rules {
+		patterns = append(patterns, f.Pattern)
+	}
+	pr.Reply = tb.ReplyMarkup{
+		ReplyKeyboard:       getReplyKeyboardForLabels(patterns),
+		ResizeReplyKeyboard: true,
+		OneTimeKeyboard:     true,
+	}
+}
+
 func AddAdminGenerator(m *tb.Message, pr *Prompt) {
 	AdminSubGenerator(m, pr, CAddAdmin)
 }
@@ -56,43 +202,22 @@ func RemoveBotGenerator(m *tb.Message, pr *Prompt) {
 		LogE.Printf("unable to get activeChat: %s", err)
 	}
 	k := fmt.Sprintf("chat:%d:botWhitelist", chatID)
-	botNames, err := R.SMembers(k).Result()
+	members, err := R.SMembers(k).Result()
 	if err != nil {
 		LogE.Printf("couldn't get bot whitelist for chat %s: %s", userID, err)
 		pr = &ErrorPrompt
 		return
 	}
-	// build keyboard for chat selection
-	keys := [][]tb.ReplyButton{}
-	buttonsPerRow := 3
-	totalCount := len(botNames)
-	// three buttons per row
-	nRows := totalCount / buttonsPerRow
-	// add another row if we have some leftovers to form an incomplete row\
-	remainderButtonCount := totalCount % buttonsPerRow
-	if remainderButtonCount > 0 {
-		nRows += 1
-	}
-	var buttonsThisRow int
-	for nR := 0; nR < nRows; nR += 1 {
-		row := []tb.ReplyButton{}
-		// if last row
-		if nR == nRows-1 && remainderButtonCount > 0 {
-			buttonsThisRow = remainderButtonCount
+	botNames := []string{}
+	for _, b := range members {
+		if id, err := strconv.Atoi(b); err == nil {
+			botNames = append(botNames, botLabel(id))
 		} else {
-			buttonsThisRow = buttonsPerRow
-		}
-		for nB := 0; nB < buttonsThisRow; nB += 1 {
-			button := tb.ReplyButton{
-				Text: botNames[(buttonsPerRow*nR)+nB],
-			}
-			// wrap the callback so the message is in the correct format
-			B.Handle(&button, interceptMessageText("", CRemoveWhitelistedBot))
-			row = append(row, button)
+			botNames = append(botNames, "@"+strings.TrimPrefix(b, "@"))
 		}
-		keys = append(keys, row)
 	}
-	if totalCount == 0 {
+	keys := getReplyKeyboardForLabels(botNames)
+	if len(botNames) == 0 {
 		pr.Text = "You don't have any whitelisted bots to remove!"
 	} else {
 		pr.Reply = tb.ReplyMarkup{
@@ -103,6 +228,133 @@ func RemoveBotGenerator(m *tb.Message, pr *Prompt) {
 	}
 }
 
+func RemoveAutoResponderGenerator(m *tb.Message, pr *Prompt) {
+	chatID, _, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		LogE.Printf("unable to get activeChat: %s", err)
+	}
+	k := fmt.Sprintf("chat:%d:autoResponders", chatID)
+	triggers, err := R.HKeys(k).Result()
+	if err != nil {
+		LogE.Printf("couldn't get auto-responders for chat %d: %s", chatID, err)
+		*pr = ErrorPrompt
+		return
+	}
+	if len(triggers) == 0 {
+		pr.Text = "You don't have any auto-responders to remove!"
+		return
+	}
+	pr.Reply = tb.ReplyMarkup{
+		ReplyKeyboard:       getReplyKeyboardForLabels(triggers),
+		ResizeReplyKeyboard: true,
+		OneTimeKeyboard:     true,
+	}
+}
+
+// shows the user what an uploaded commands file would change
+// before asking them to confirm the import
+func ImportCommandsGenerator(m *tb.Message, pr *Prompt) {
+	chatID, _, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		LogE.Printf("unable to get activeChat: %s", err)
+		*pr = ErrorPrompt
+		return
+	}
+	imported, err := readCommandFile(m)
+	if err != nil {
+		LogW.Printf("unable to read commands file from %d: %s", m.Sender.ID, err)
+		pr.Text = fmt.Sprintf("I couldn't read that file: %s", err)
+		pr.Reply = tb.ReplyMarkup{
+			ReplyKeyboard:       [][]tb.ReplyButton{{{Text: "Cancel"}}},
+			ResizeReplyKeyboard: true,
+			OneTimeKeyboard:     true,
+		}
+		return
+	}
+	current, err := getCommandFile(chatID)
+	if err != nil {
+		LogE.Print(err)
+		*pr = ErrorPrompt
+		return
+	}
+	pr.Text = fmt.Sprintf("%s\n\nWould you like to apply these changes?", diffCommandFiles(current, imported))
+	pr.Reply = tb.ReplyMarkup{
+		ReplyKeyboard:       [][]tb.ReplyButton{{{Text: "Apply"}, {Text: "Cancel"}}},
+		ResizeReplyKeyboard: true,
+		OneTimeKeyboard:     true,
+	}
+}
+
+// offers the chat's schedules as buttons, the picked one's label is the
+// answer and starts with its ID
+func PickScheduleGenerator(m *tb.Message, pr *Prompt) {
+	chatID, _, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		LogE.Printf("unable to get activeChat: %s", err)
+	}
+	schedules, err := getSchedules(int64(chatID))
+	if err != nil {
+		LogE.Print(err)
+		*pr = ErrorPrompt
+		return
+	}
+	if len(schedules) == 0 {
+		pr.Text = "You don't have any scheduled messages!"
+		return
+	}
+	keys := [][]tb.ReplyButton{}
+	for _, s := range schedules {
+		label := s.String()
+		if s.Paused {
+			label += " (paused)"
+		}
+		keys = append(keys, []tb.ReplyButton{{Text: label}})
+	}
+	pr.Reply = tb.ReplyMarkup{
+		ReplyKeyboard:       keys,
+		ResizeReplyKeyboard: true,
+		OneTimeKeyboard:     true,
+	}
+}
+
+// offers the sender's ban lists as buttons, the picked list's name is the answer
+func PickBanListGenerator(m *tb.Message, pr *Prompt) {
+	names := getBanLists(m.Sender.ID)
+	if len(names) == 0 {
+		pr.Text = "You don't have any ban lists, add one with /addbanlist"
+		return
+	}
+	keys := [][]tb.ReplyButton{}
+	for _, name := range names {
+		keys = append(keys, []tb.ReplyButton{{Text: name}})
+	}
+	pr.Reply = tb.ReplyMarkup{
+		ReplyKeyboard:       keys,
+		ResizeReplyKeyboard: true,
+		OneTimeKeyboard:     true,
+	}
+}
+
+// lays the labels out three to a row, pressing one just sends its label so
+// the path using the keyboard gets it as the answer, no handler is
+// registered for it as that would catch the same text posted in a group
+func getReplyKeyboardForLabels(labels []string) [][]tb.ReplyButton {
+	keys := [][]tb.ReplyButton{}
+	buttonsPerRow := 3
+	row := []tb.ReplyButton{}
+	for _, label := range labels {
+		row = append(row, tb.ReplyButton{Text: label})
+		if len(row) == buttonsPerRow {
+			keys = append(keys, row)
+			row = []tb.ReplyButton{}
+		}
+	}
+	if len(row) > 0 {
+		keys = append(keys, row)
+	}
+	return keys
+}
+
 func AdminSubGenerator(m *tb.Message, pr *Prompt, consumer ConsumerType) {
 	userID := m.Sender.ID
 	chatID, _, err := getUsersActiveChat(userID)
@@ -169,7 +421,9 @@ func AdminSubGenerator(m *tb.Message, pr *Prompt, consumer ConsumerType) {
 	}
 }
 
-func ChatSubGenerator(m *tb.Message, pr *Prompt, consumer ConsumerType) {
+// builds a keyboard of the user's chats, pressing a chat calls the consumer
+// with the chat ID or, without a consumer, answers the user's active path
+func ChatSubGenerator(m *tb.Message, pr *Prompt, consumer ConsumerType, excludeIDs ...int) {
 	userID := m.Sender.ID
 	// grab chat ids associated with user
 	k := fmt.Sprintf("user:%d:chats", userID)
@@ -189,9 +443,15 @@ func ChatSubGenerator(m *tb.Message, pr *Prompt, consumer ConsumerType) {
 			pr = &ErrorPrompt
 			return
 		} else {
+			if containsInt(excludeIDs, id) {
+				continue
+			}
 			// create a button for each chat
 			chatTitle, _ := getChatTitle(id)
 			wrappedCallback := interceptMessageText(fmt.Sprintf("%d", id), consumer)
+			if consumer == "" {
+				wrappedCallback = interceptPathText(fmt.Sprintf("%d", id))
+			}
 			button := tb.ReplyButton{
 				Text: chatTitle,
 			}
@@ -259,32 +519,322 @@ var BuiltinCommandRegistry = map[string]func(*tb.Message){
 	"/addcommand": wrapPathBegin(Path{
 		Prompts: []Prompt{
 			{Text: "What's the name of the command?"},
-			{Text: "What would you like the response to be? (Markdown formatting is supported)"},
+			{
+				Text:    "How should the response be formatted?",
+				Buttons: ParseModeButtons,
+			},
+			{Text: "What would you like the response to be?"},
+			{Text: "What links would you like to show as buttons under the response? \n" +
+				"(one row of buttons per line, buttons in a row separated by |, each written as Text - URL) \n" +
+				"(example: Website - https://example.com | Whitepaper - https://example.com/wp.pdf) \n" +
+				"(send None for no buttons)"},
+			{
+				GenerateMessage: GPreviewCommand,
+				RewindOn:        "Edit",
+				RewindTo:        2,
+			},
 		},
 		Consumer: CAddCommand,
 	}),
+	"/addcommandpool": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{Text: "What's the name of the command?"},
+			{
+				Text:    "Should the command respond with one random response or with every response in order?",
+				Buttons: [][]string{{PoolRandom, PoolSequence}},
+			},
+			{
+				Text:    "How should the text and captions of the responses be formatted?",
+				Buttons: ParseModeButtons,
+			},
+			{
+				Text: "Send me each response as its own message, they can be text, photos, GIFs or stickers. \n" +
+					"(to make a random response more likely start it or its caption with a weight, such as: 5|gm fren) \n" +
+					"(press Done when you've sent them all)",
+				Buttons:     [][]string{{PoolDone}},
+				RepeatUntil: PoolDone,
+			},
+			{Text: fmt.Sprintf("How many seconds should I wait between each message of a sequence? (0 to %d)", maxPoolDelay)},
+		},
+		Consumer: CAddCommandPool,
+	}),
 	"/removecommand": wrapPathBegin(Path{
 		Prompts: []Prompt{
 			{Text: "What command would you like to remove?"},
 		},
 		Consumer: CRemoveCommand,
 	}),
-	"/viewcommands": wrapSingleMessage(ConsumerRegistry[CViewCommands]),
+	"/viewcommands":   wrapSingleMessage(ConsumerRegistry[CViewCommands]),
+	"/exportcommands": wrapSingleMessage(ConsumerRegistry[CExportCommands]),
+	"/importcommands": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{Text: "Send me a commands file exported with /exportcommands"},
+			{GenerateMessage: GImportCommands},
+		},
+		Consumer: CImportCommands,
+	}),
 	"/setwelcome": wrapPathBegin(Path{
 		Prompts: []Prompt{
+			{
+				Text:    "How should the welcome message be formatted?",
+				Buttons: ParseModeButtons,
+			},
 			{Text: `What is the message you would like to welcome your users with?
 (you can use $username to be replaced with the new members username)`},
+			{
+				GenerateMessage: GPreviewWelcome,
+				RewindOn:        "Edit",
+				RewindTo:        1,
+			},
 			{Text: "How many users do you want to join between each welcome message?"},
 		},
 		Consumer: CSetWelcome,
 	}),
 	"/togglejoinmsg": wrapSingleMessage(ConsumerRegistry[CToggleJoinMessage]),
+	"/setcaptcha": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:    "What should new users have to do before they can chat?",
+				Buttons: CaptchaModeButtons,
+			},
+			{
+				Text:    "How many seconds should they have before they're kicked?",
+				Buttons: [][]string{{"60", "120", "300"}},
+			},
+		},
+		Consumer: CSetCaptcha,
+	}),
+	"/setflood": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{Text: "How many messages can one user send within the window? (send 0 for no limit)"},
+			{Text: "How many seconds long is the window? (send 0 to turn flood protection off)"},
+			{Text: "How many times can a user send the same message within the window? (send 0 for no limit)"},
+			{Text: "How many photos, videos, GIFs, stickers or files can a user send within the window? (send 0 for no limit)"},
+			{Text: "How many minutes should a user be muted the second time they flood the chat? (send 0 to skip muting)"},
+			{
+				Text:    "What should happen the third time they flood the chat?",
+				Buttons: [][]string{{FloodKick, FloodBan}},
+			},
+		},
+		Consumer: CSetFlood,
+	}),
+	"/setraid": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{Text: "How many people can join within the window before the chat is locked down? (send 0 to turn raid protection off)"},
+			{Text: "How many seconds long is the window?"},
+			{
+				Text:    "How many minutes should a lockdown last? The owner can end it sooner",
+				Buttons: [][]string{{"15", "30", "60"}},
+			},
+			{
+				Text:    "Should everyone other than admins be stopped from talking during a lockdown?",
+				Buttons: [][]string{{"Yes", "No"}},
+			},
+		},
+		Consumer: CSetRaid,
+	}),
+	"/setnightmode": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:    "What should members other than admins be stopped from posting during quiet hours?",
+				Buttons: NightModeButtons,
+			},
+			{Text: "When should quiet hours start? (send a time like 23:00)"},
+			{Text: "When should they end? (send a time like 07:00)"},
+			{
+				Text:    "Which timezone are those times in? (send a name like Europe/London)",
+				Buttons: [][]string{{"UTC"}},
+			},
+			{
+				Text:    "What should I post when quiet hours start? It's deleted when they end (send None to post nothing)",
+				Buttons: [][]string{{NoNotice}},
+			},
+		},
+		Consumer: CSetNightMode,
+	}),
+	"/setwarnings": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{Text: "How many hours should a warning count for? (send 0 to never expire)"},
+			{Text: "After how many warnings should a user be muted? (send 0 to never mute)"},
+			{Text: "How many minutes should they be muted for?"},
+			{Text: "After how many warnings should a user be removed from the chat? (send 0 to never remove)"},
+			{Text: "After how many warnings should a user be banned? (send 0 to never ban)"},
+			{
+				Text:    "Should users caught by flood protection, denied domains or the address guard be warned too?",
+				Buttons: [][]string{{"Yes", "No"}},
+			},
+		},
+		Consumer: CSetWarnings,
+	}),
+	"/addfilters": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:    "How should the filters be matched? (keywords and phrases ignore case, leetspeak, punctuation and invisible characters)",
+				Buttons: [][]string{{TriggerKeyword, TriggerPhrase, TriggerRegex}},
+			},
+			{
+				Text:    "What should happen when a message matches one of them?",
+				Buttons: FilterActionButtons,
+			},
+			{Text: "What words, phrases or regular expressions should be filtered? (send one per line)"},
+		},
+		Consumer: CAddFilters,
+	}),
+	"/removefilter": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:            "Which filter would you like to remove?",
+				GenerateMessage: GRemoveFilter,
+			},
+		},
+		Consumer: CRemoveFilter,
+	}),
+	"/viewfilters": wrapSingleMessage(ConsumerRegistry[CViewFilters]),
+	"/addnamefilters": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text: "How should names be matched? Keywords, phrases and regular expressions are checked against " +
+					"first names, last names and usernames, the rest are built in checks",
+				Buttons: [][]string{{TriggerKeyword, TriggerPhrase, TriggerRegex}, {NameLink, NameDirection, NameEmoji}},
+			},
+			{
+				Text:    "What should happen to a user whose name matches?",
+				Buttons: NameActionButtons,
+			},
+			{Text: "What words, phrases or regular expressions should be matched? (send one per line, " +
+				"for emojis send how many make a name suspicious, for the other built in checks send anything)"},
+		},
+		Consumer: CAddNameFilters,
+	}),
+	"/removenamefilter": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:            "Which name filter would you like to remove?",
+				GenerateMessage: GRemoveNameFilter,
+			},
+		},
+		Consumer: CRemoveNameFilter,
+	}),
+	"/viewnamefilters": wrapSingleMessage(ConsumerRegistry[CViewNameFilters]),
+	"/setimpersonation": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text: "What should happen to users whose name or username looks like one of the admins'? " +
+					"The admins are told either way",
+				Buttons: [][]string{{NameBan, NameReview}, {ImpersonationOff}},
+			},
+		},
+		Consumer: CSetImpersonation,
+	}),
+	"/setauditlog": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text: "Where should moderation actions be posted? Add me to a channel or group as an admin, " +
+					"then forward me a message from it or send its ID (send None to only keep the audit log)",
+				Buttons: [][]string{{NoNotice}},
+			},
+		},
+		Consumer: CSetAuditLog,
+	}),
+	"/viewauditlog": wrapSingleMessage(ConsumerRegistry[CViewAuditLog]),
+	"/addbanlist": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{Text: "What should the ban list be called? The chat you're managing will be subscribed to it"},
+		},
+		Consumer: CAddBanList,
+	}),
+	"/togglebanlist": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:            "Which ban list should the chat you're managing subscribe to or leave?",
+				GenerateMessage: GPickBanList,
+			},
+		},
+		Consumer: CToggleBanList,
+	}),
+	"/viewbanlists": wrapSingleMessage(ConsumerRegistry[CViewBanLists]),
+	"/exportbanlist": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:            "Which ban list would you like to export?",
+				GenerateMessage: GPickBanList,
+			},
+		},
+		Consumer: CExportBanList,
+	}),
+	"/importbanlist": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:            "Which ban list should the users be added to?",
+				GenerateMessage: GPickBanList,
+			},
+			{Text: "Send me a ban list file exported with /exportbanlist"},
+		},
+		Consumer: CImportBanList,
+	}),
+	"/togglenativerestriction": wrapSingleMessage(ConsumerRegistry[CToggleNativeRestrict]),
+	"/allowdomains": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{Text: "Which domains can new users link to? (separate them with spaces or new lines, subdomains are included)"},
+		},
+		Consumer: CAllowDomains,
+	}),
+	"/denydomains": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{Text: "Which domains should nobody be able to link to? (separate them with spaces or new lines, subdomains are included)"},
+		},
+		Consumer: CDenyDomains,
+	}),
+	"/removedomain": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:            "Which domain would you like to remove?",
+				GenerateMessage: GRemoveDomain,
+			},
+		},
+		Consumer: CRemoveDomain,
+	}),
+	"/viewdomains": wrapSingleMessage(ConsumerRegistry[CViewDomains]),
+	"/toggleaddressguard": wrapSingleMessage(ConsumerRegistry[CToggleAddressGuard]),
+	"/allowaddresses": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{Text: "What are the official wallet and contract addresses? (separate them with spaces or new lines)"},
+		},
+		Consumer: CAllowAddresses,
+	}),
+	"/removeaddress": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:            "Which address would you like to remove?",
+				GenerateMessage: GRemoveAddress,
+			},
+		},
+		Consumer: CRemoveAddress,
+	}),
+	"/viewaddresses": wrapSingleMessage(ConsumerRegistry[CViewAddresses]),
 	"/addwhitelistedbot": wrapPathBegin(Path{
 		Prompts: []Prompt{
-			{Text: "What is the username of the bot you would like to whitelist?"},
+			{Text: "Which bot would you like to whitelist? Forward me a message from it, or send its username or ID"},
 		},
 		Consumer: CAddWhitelistedBot,
 	}),
+	"/viewblockedbots": wrapSingleMessage(ConsumerRegistry[CViewBlockedBots]),
+	"/setblockedbotaction": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:    "What should happen to bots that join without being whitelisted?",
+				Buttons: BotActionButtons,
+			},
+			{
+				Text: "What notice should be posted when a bot is removed? \n" +
+					"(possible variables are {{.Bot}}, {{.AddedBy}} and {{.ChatTitle}}) \n" +
+					"(send None to remove bots without posting anything)",
+				Buttons: [][]string{{NoNotice}},
+			},
+			{Text: "How many seconds should the notice stay up? (send 0 to keep it)"},
+		},
+		Consumer: CSetBlockedBotAction,
+	}),
 	"/removewhitelistedbot": wrapPathBegin(Path{
 		Prompts: []Prompt{
 			{
@@ -292,6 +842,92 @@ var BuiltinCommandRegistry = map[string]func(*tb.Message){
 				GenerateMessage: GRemoveBotGenerator,
 			},
 		},
+		Consumer: CRemoveWhitelistedBot,
+	}),
+	"/addautoresponder": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:    "How should the trigger be matched?",
+				Buttons: [][]string{{TriggerKeyword, TriggerPhrase, TriggerRegex}},
+			},
+			{Text: "What keyword, phrase or regular expression should trigger the response? \n" +
+				"(regular expressions are case sensitive unless they start with (?i))"},
+			{Text: "What would you like the response to be? (the same variables as custom commands are supported)"},
+			{Text: "How many seconds should I wait before responding to this trigger again? (0 for no cooldown)"},
+			{
+				Text:    "Should the response be sent as a reply to the triggering message?",
+				Buttons: [][]string{{"Yes", "No"}},
+			},
+		},
+		Consumer: CAddAutoResponder,
+	}),
+	"/removeautoresponder": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:            "Which auto-responder would you like to remove?",
+				GenerateMessage: GRemoveAutoResponder,
+			},
+		},
+		Consumer: CRemoveAutoResponder,
+	}),
+	"/viewautoresponders": wrapSingleMessage(ConsumerRegistry[CViewAutoResponders]),
+	"/clonechat": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				GenerateMessage: GCloneSource,
+				Text:            "Which chat would you like to copy settings from?",
+			},
+			{
+				GenerateMessage: GCloneTarget,
+				Text:            "Which chat would you like to copy the settings to?",
+			},
+			{
+				Text:      "Which settings would you like to copy? (existing settings in the target chat will be replaced)",
+				Checklist: cloneSettingLabels(),
+			},
+		},
+		Consumer: CCloneChat,
+	}),
+	"/addschedule": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{Text: "How often should the message be posted? \n" +
+				"(an interval such as: every 6h, or a cron expression in UTC such as: 0 9 * * 1-5 for weekdays at 09:00)"},
+			{
+				Text:    "How should the message be formatted?",
+				Buttons: ParseModeButtons,
+			},
+			{Text: "What message would you like to post? \n" +
+				"(possible variables are {{.ChatTitle}} and {{.Time}})"},
+		},
+		Consumer: CAddSchedule,
+	}),
+	"/viewschedules": wrapSingleMessage(ConsumerRegistry[CViewSchedules]),
+	"/pauseschedule": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:            "Which scheduled message would you like to pause or resume?",
+				GenerateMessage: GPickSchedule,
+			},
+		},
+		Consumer: CToggleSchedule,
+	}),
+	"/removeschedule": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:            "Which scheduled message would you like to remove?",
+				GenerateMessage: GPickSchedule,
+			},
+		},
+		Consumer: CRemoveSchedule,
+	}),
+	"/setmediapolicy": wrapPathBegin(Path{
+		Prompts: []Prompt{
+			{
+				Text:            "What should new users be blocked from posting while they're restricted?",
+				GenerateMessage: GMediaPolicy,
+			},
+		},
+		Consumer: CSetMediaPolicy,
 	}),
 	"/setpricecommand": wrapPathBegin(Path{
 		Prompts: []Prompt{
@@ -303,9 +939,18 @@ var BuiltinCommandRegistry = map[string]func(*tb.Message){
 				"PLN, RUB, SEK, SGD, THB, TRY, TWD, ZAR)\n" +
 				"(crypto options are: BTC, ETH, XRP, LTC, BCH)",
 			},
+			{
+				Text:    "How should the message be formatted?",
+				Buttons: ParseModeButtons,
+			},
 			{Text: "What message would you like to display as a response to the command? \n" +
 				"(example: '{{ticker}} is trading at ${{price}} USD and Ƀ{{conversion}} BTC) /n" +
 				"(possible variables are {{ticker}}, {{name}}, {{slug}}, {{price}}, {{price_pct_change}}, {{conversion}}, {{conversion_pct_change}}"},
+			{
+				GenerateMessage: GPreviewPrice,
+				RewindOn:        "Edit",
+				RewindTo:        3,
+			},
 		},
 		Consumer: CSetPriceCommand,
 	}),
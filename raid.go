@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// how long a lockdown lasts when the chat hasn't set a cool-down
+const defaultLockdownMinutes = 30
+
+// inline button sent to the owner that ends a lockdown early, its data is the chat ID
+var unlockButton = tb.InlineButton{Unique: "unlockchat", Text: "Unlock Now"}
+
+// how many joins within the window count as a raid, 0 turns detection off
+type RaidSettings struct {
+	Joins           int
+	Window          int
+	CoolDownMinutes int
+	// whether everyone other than admins is stopped from talking during a lockdown
+	Silence bool
+}
+
+func getRaidSettings(chatID int64) RaidSettings {
+	settings, _ := R.HGetAll(fmt.Sprintf("chat:%d:raid", chatID)).Result()
+	s := RaidSettings{Silence: settings["silence"] == "Yes"}
+	s.Joins, _ = strconv.Atoi(settings["joins"])
+	s.Window, _ = strconv.Atoi(settings["window"])
+	s.CoolDownMinutes, _ = strconv.Atoi(settings["coolDown"])
+	if s.CoolDownMinutes <= 0 {
+		s.CoolDownMinutes = defaultLockdownMinutes
+	}
+	return s
+}
+
+func lockdownKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:lockdown", chatID)
+}
+
+// how long the chat's lockdown has left, 0 if it isn't locked down
+func lockdownRemaining(chatID int64) time.Duration {
+	until, err := R.Get(lockdownKey(chatID)).Int64()
+	if err != nil {
+		return 0
+	}
+	if remaining := time.Until(time.Unix(until, 0)); remaining > 0 {
+		return remaining
+	}
+	// the unlock job hasn't run yet
+	return time.Second
+}
+
+func inLockdown(chatID int64) bool {
+	return lockdownRemaining(chatID) > 0
+}
+
+// counts the join towards the chat's join rate and locks the chat down if
+// it's too high, returns how long the chat's lockdown has left
+func detectRaid(m *tb.Message, u *tb.User) time.Duration {
+	if remaining := lockdownRemaining(m.Chat.ID); remaining > 0 {
+		return remaining
+	}
+	s := getRaidSettings(m.Chat.ID)
+	if s.Joins <= 0 || s.Window <= 0 {
+		return 0
+	}
+	joins, err := floodWindow(fmt.Sprintf("chat:%d:joins", m.Chat.ID), u.ID, time.Duration(s.Window)*time.Second)
+	if err != nil {
+		LogE.Print(err)
+		return 0
+	}
+	if len(joins) <= s.Joins {
+		return 0
+	}
+	lockdown(m.Chat, s, len(joins))
+	return lockdownRemaining(m.Chat.ID)
+}
+
+// puts the chat in its strictest mode until the cool-down is over, newcomers
+// get a captcha and can't post media or links and everyone else can be silenced
+func lockdown(chat *tb.Chat, s RaidSettings, joins int) {
+	coolDown := time.Duration(s.CoolDownMinutes) * time.Minute
+	until := time.Now().Add(coolDown)
+	// only the first join over the limit locks the chat
+	if locked, err := R.SetNX(lockdownKey(chat.ID), until.Unix(), 0).Result(); err != nil || !locked {
+		return
+	}
+	LogI.Printf("locked down chat %d after %d joins", chat.ID, joins)
+	// the chat is only silenced if its permissions can be given back afterwards
+	if s.Silence && saveBasePermissions(chat.ID) {
+		R.Set(lockdownSilencedKey(chat.ID), 1, 0)
+		if err := applyChatRestrictions(chat.ID); err != nil {
+			LogE.Printf("couldn't silence chat %d during a lockdown: %s", chat.ID, err)
+		}
+	}
+	if err := queueJob(Job{Type: JUnlockChat, ChatID: chat.ID}, until); err != nil {
+		LogE.Printf("lockdown of chat %d won't end on its own: %s", chat.ID, err)
+	}
+	B.Send(chat, fmt.Sprintf("%d people joined in a short time, the chat is locked down for %d minutes. "+
+		"New users have to solve a captcha and can't post media or links", joins, s.CoolDownMinutes))
+	audit(AuditEntry{ChatID: chat.ID, Action: AuditLockdown, Reason: fmt.Sprintf("%d joins", joins)})
+
+	owner, err := R.Get(fmt.Sprintf("chat:%d:owner", chat.ID)).Int64()
+	if err != nil {
+		return
+	}
+	title, _ := getChatTitle(int(chat.ID))
+	button := unlockButton
+	button.Data = strconv.FormatInt(chat.ID, 10)
+	_, err = B.Send(&tb.User{ID: int(owner)}, fmt.Sprintf("%d people joined %s within %d seconds, "+
+		"it's locked down until %s", joins, title, s.Window, until.UTC().Format("15:04 MST")),
+		&tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{{button}}})
+	if err != nil {
+		LogW.Printf("couldn't tell the owner of chat %d about a lockdown: %s", chat.ID, err)
+	}
+}
+
+// ends the lockdown and gives the chat back the permissions it had, or
+// its quiet hours ones if night mode is on, by is nil when the cool-down
+// ended it
+func unlockChat(chatID int64, by *tb.User) error {
+	if R.Del(lockdownKey(chatID)).Val() == 0 {
+		return nil
+	}
+	// the joins that caused the lockdown shouldn't start another one
+	R.Del(fmt.Sprintf("chat:%d:joins", chatID))
+	chat := &tb.Chat{ID: chatID}
+	if R.Del(lockdownSilencedKey(chatID)).Val() == 1 {
+		if err := applyChatRestrictions(chatID); err != nil {
+			return errors.Wrap(err, "couldn't restore permissions after a lockdown")
+		}
+	}
+	B.Send(chat, "The lockdown is over")
+	audit(AuditEntry{ChatID: chatID, Action: AuditUnlock}.by(by))
+	return nil
+}
+
+func unlockQueuedChat(j Job) error {
+	until, err := R.Get(lockdownKey(j.ChatID)).Int64()
+	// a later lockdown queued its own job
+	if err != nil || time.Now().Unix() < until {
+		return nil
+	}
+	return unlockChat(j.ChatID, nil)
+}
+
+func onUnlockCallback(c *tb.Callback) {
+	chatID, _ := strconv.ParseInt(c.Data, 10, 64)
+	if owner, _ := userHasAdminManagementAccess(c.Sender.ID, int(chatID)); !owner {
+		B.Respond(c, &tb.CallbackResponse{Text: "Only the owner of the chat can end the lockdown"})
+		return
+	}
+	if err := unlockChat(chatID, c.Sender); err != nil {
+		LogE.Print(err)
+		B.Respond(c, &tb.CallbackResponse{Text: ErrorResponse})
+		return
+	}
+	B.EditReplyMarkup(c.Message, nil)
+	B.Respond(c, &tb.CallbackResponse{Text: "The chat has been unlocked"})
+}
+
+// receives the join limit, window, cool-down and whether to silence the chat
+func setRaid(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	names := []string{"join limit", "window", "cool-down"}
+	values := []int{}
+	for i, name := range names {
+		v, err := strconv.Atoi(ms[i].Text)
+		if err != nil || v < 0 {
+			B.Send(sender, fmt.Sprintf("Raid protection wasn't saved, the %s needs to be a number", name))
+			return nil
+		}
+		values = append(values, v)
+	}
+	silence := ms[3].Text
+	if silence != "Yes" && silence != "No" {
+		B.Send(sender, "Raid protection wasn't saved, answer Yes or No for silencing the chat")
+		return
+	}
+	err = R.HMSet(fmt.Sprintf("chat:%d:raid", chatID), map[string]interface{}{
+		"joins":    values[0],
+		"window":   values[1],
+		"coolDown": values[2],
+		"silence":  silence,
+	}).Err()
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't save raid settings for chat %d", chatID)
+	}
+	if values[0] == 0 || values[1] == 0 {
+		B.Send(sender, "Raid protection has been turned off for "+chatTitle)
+		return
+	}
+	B.Send(sender, fmt.Sprintf("%s will be locked down when more than %d people join within %d seconds, "+
+		"I'll message the chat's owner when it happens. Make sure I'm an admin that can ban users",
+		chatTitle, values[0], values[1]))
+	return
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// what an admin can do about a report
+const (
+	ReportDelete  = "Delete"
+	ReportWarn    = "Warn"
+	ReportMute    = "Mute"
+	ReportBan     = "Ban"
+	ReportDismiss = "Dismiss"
+)
+
+// how long a report can be acted on
+const reportTTL = 48 * time.Hour
+
+// how long the thank you for a report stays up in the chat
+const reportNoticeTTL = 30 * time.Second
+
+// inline buttons under a report sent to admins, their data is "reportID:action"
+var reportButton = tb.InlineButton{Unique: "report"}
+
+// a message a member reported and the DMs sent to admins about it
+type Report struct {
+	ChatID     int64
+	ChatTitle  string
+	MessageID  int
+	UserID     int
+	UserName   string
+	ReporterID int
+	Reporter   string
+	Reason     string
+	Link       string
+	// the DM sent to each admin, so they can all be updated once it's resolved
+	Notices []ReportNotice
+}
+
+type ReportNotice struct {
+	AdminID   int
+	MessageID int
+}
+
+func (r Report) String() string {
+	s := fmt.Sprintf("%s reported %s in %s", r.Reporter, r.UserName, r.ChatTitle)
+	if r.Reason != "" {
+		s += ": " + r.Reason
+	}
+	if r.Link != "" {
+		s += "\n" + r.Link
+	}
+	return s
+}
+
+func reportKey(id string) string {
+	return fmt.Sprintf("report:%s", id)
+}
+
+func getReportMarkup(id string) *tb.ReplyMarkup {
+	row := []tb.InlineButton{}
+	for _, action := range []string{ReportDelete, ReportWarn, ReportMute, ReportBan, ReportDismiss} {
+		button := reportButton
+		button.Text, button.Data = action, id+":"+action
+		row = append(row, button)
+	}
+	return &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{row[:3], row[3:]}}
+}
+
+// /report as a reply to a message, followed by an optional reason, anyone can use it
+func reportCommand(m *tb.Message) {
+	if m.Private() || m.Sender == nil {
+		return
+	}
+	if m.ReplyTo == nil || m.ReplyTo.Sender == nil {
+		B.Reply(m, "Reply to the message you want to report")
+		return
+	}
+	offender := m.ReplyTo.Sender
+	if offender.ID == B.Me.ID || isKnownAdmin(m.Chat.ID, offender.ID) {
+		B.Reply(m, "Admins can't be reported")
+		return
+	}
+	// each message only needs to be reported once
+	reportedKey := fmt.Sprintf("chat:%d:reported:%d", m.Chat.ID, m.ReplyTo.ID)
+	if ok, _ := R.SetNX(reportedKey, m.Sender.ID, reportTTL).Result(); !ok {
+		B.Delete(m)
+		return
+	}
+	admins, err := R.SMembers(fmt.Sprintf("chat:%d:activeAdmins", m.Chat.ID)).Result()
+	if err != nil || len(admins) == 0 {
+		// let the message be reported again once there's someone to tell
+		R.Del(reportedKey)
+		B.Reply(m, "This chat doesn't have any admins I can tell")
+		return
+	}
+	id, err := R.Incr("beru:reportCounter").Result()
+	if err != nil {
+		LogE.Printf("couldn't number a report in chat %d: %s", m.Chat.ID, err)
+		R.Del(reportedKey)
+		B.Reply(m, ErrorResponse)
+		return
+	}
+	r := Report{
+		ChatID:     m.Chat.ID,
+		ChatTitle:  m.Chat.Title,
+		MessageID:  m.ReplyTo.ID,
+		UserID:     offender.ID,
+		UserName:   displayName(offender),
+		ReporterID: m.Sender.ID,
+		Reporter:   displayName(m.Sender),
+		Reason:     strings.TrimSpace(m.Payload),
+		Link:       messageLink(m.ReplyTo),
+	}
+	reportID := strconv.FormatInt(id, 10)
+	for _, a := range admins {
+		adminID, _ := strconv.Atoi(a)
+		admin := &tb.User{ID: adminID}
+		// the admin may not be able to see the message if it's deleted before they get to it
+		B.Forward(admin, m.ReplyTo)
+		sent, err := B.Send(admin, r.String(), getReportMarkup(reportID), tb.NoPreview)
+		if err != nil {
+			LogW.Printf("couldn't send report %s to admin %d: %s", reportID, adminID, err)
+			continue
+		}
+		r.Notices = append(r.Notices, ReportNotice{AdminID: adminID, MessageID: sent.ID})
+	}
+	if len(r.Notices) == 0 {
+		R.Del(reportedKey)
+		B.Reply(m, "I couldn't reach any of the admins, they need to start a chat with me first")
+		return
+	}
+	if err := R.Set(reportKey(reportID), EncodeReport(&r), reportTTL).Err(); err != nil {
+		LogE.Printf("couldn't save report %s: %s", reportID, err)
+	}
+	B.Delete(m)
+	if sent, err := B.Send(m.Chat, fmt.Sprintf("Thanks %s, the admins have been told", r.Reporter)); err == nil {
+		deleteMessageLater(sent, reportNoticeTTL)
+	}
+}
+
+// does what the admin chose and returns the audit log action for it, "" if there isn't one
+func actOnReport(r Report, action string, admin *tb.User) (string, error) {
+	chat := &tb.Chat{ID: r.ChatID, Title: r.ChatTitle}
+	u := knownUser(r.UserID)
+	// the message may already be gone, which shouldn't stop the report being resolved
+	msg := &tb.Message{ID: r.MessageID, Chat: chat}
+	if action != ReportDismiss {
+		B.Delete(msg)
+	}
+	switch action {
+	case ReportDelete:
+		return AuditDelete, nil
+	case ReportWarn:
+		_, err := issueWarning(chat, u, "reported by "+r.Reporter, admin)
+		// issuing a warning adds its own entry to the audit log
+		return "", err
+	case ReportMute:
+		return AuditMute, muteMember(chat, u, defaultMuteUntil(r.ChatID))
+	case ReportBan:
+		if err := B.Ban(chat, &tb.ChatMember{User: u, RestrictedUntil: tb.Forever()}); err != nil {
+			return "", err
+		}
+		propagateBan(chat, u, "reported by "+r.Reporter)
+		return AuditBan, nil
+	}
+	return "", nil
+}
+
+// the first admin to press one of the buttons resolves the report for all of them
+func onReportCallback(c *tb.Callback) {
+	parts := strings.SplitN(c.Data, ":", 2)
+	if len(parts) != 2 {
+		B.Respond(c, &tb.CallbackResponse{})
+		return
+	}
+	id, action := parts[0], parts[1]
+	data, err := R.Get(reportKey(id)).Bytes()
+	if err != nil {
+		B.EditReplyMarkup(c.Message, nil)
+		B.Respond(c, &tb.CallbackResponse{Text: "This report has expired"})
+		return
+	}
+	r := DecodeReport(data)
+	if !isActiveAdmin(c.Sender.ID, r.ChatID) {
+		B.Respond(c, &tb.CallbackResponse{Text: "You're no longer an admin of " + r.ChatTitle})
+		return
+	}
+	if ok, _ := R.SetNX(reportKey(id)+":resolved", c.Sender.ID, reportTTL).Result(); !ok {
+		B.EditReplyMarkup(c.Message, nil)
+		B.Respond(c, &tb.CallbackResponse{Text: "Another admin already handled this report"})
+		return
+	}
+	auditAction, err := actOnReport(r, action, c.Sender)
+	if err != nil {
+		LogE.Print(errors.Wrapf(err, "couldn't %s for report %s", strings.ToLower(action), id))
+		R.Del(reportKey(id) + ":resolved")
+		B.Respond(c, &tb.CallbackResponse{Text: ErrorResponse})
+		return
+	}
+	if auditAction != "" {
+		audit(AuditEntry{ChatID: r.ChatID, Action: auditAction, Reason: "reported by " + r.Reporter,
+			Link: r.Link}.by(c.Sender).against(knownUser(r.UserID)))
+	}
+	resolved := fmt.Sprintf("%s\n\nResolved by %s: %s", r, displayName(c.Sender), action)
+	for _, n := range r.Notices {
+		notice := &tb.Message{ID: n.MessageID, Chat: &tb.Chat{ID: int64(n.AdminID)}}
+		B.Edit(notice, resolved, &tb.ReplyMarkup{}, tb.NoPreview)
+	}
+	R.Del(reportKey(id))
+	B.Respond(c, &tb.CallbackResponse{Text: "The report has been resolved"})
+	// the reporter only gets this if they've started a chat with beru
+	B.Send(&tb.User{ID: r.ReporterID}, fmt.Sprintf("Your report in %s has been handled, thanks", r.ChatTitle))
+}
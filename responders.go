@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// the ways an auto-responder trigger can be compared against
+// the text of an incoming message
+const (
+	TriggerKeyword = "Keyword"
+	TriggerPhrase  = "Phrase"
+	TriggerRegex   = "Regex"
+)
+
+// an auto-responder replies to plain (non command) text in a chat
+// whenever its trigger matches the message
+type AutoResponder struct {
+	// Keyword, Phrase or Regex
+	Kind string
+	// the keyword, phrase or regular expression to look for
+	Trigger string
+	// template rendered with the triggering message, same as custom commands
+	Response string
+	// seconds to wait before the responder can fire again in the chat
+	Cooldown int64
+	// whether the response is sent as a reply to the triggering message
+	ReplyToTrigger bool
+}
+
+// compiled trigger patterns keyed by the responder's field, so they aren't
+// compiled again for every message
+var responderPatterns = struct {
+	sync.RWMutex
+	m map[string]*regexp.Regexp
+}{m: map[string]*regexp.Regexp{}}
+
+// the responder's field in the chat's auto-responders, a keyword and a
+// regular expression can share a trigger so both are part of it
+func (a AutoResponder) field() string {
+	return a.Kind + ":" + a.Trigger
+}
+
+// builds the regular expression used to match the trigger, keywords
+// have to match whole words while phrases can appear anywhere
+func (a AutoResponder) pattern() (*regexp.Regexp, error) {
+	key := a.field()
+	responderPatterns.RLock()
+	re, ok := responderPatterns.m[key]
+	responderPatterns.RUnlock()
+	if ok {
+		return re, nil
+	}
+	var err error
+	switch a.Kind {
+	case TriggerKeyword:
+		re, err = regexp.Compile(`(?i)\b` + regexp.QuoteMeta(a.Trigger) + `\b`)
+	case TriggerPhrase:
+		re, err = regexp.Compile(`(?i)` + regexp.QuoteMeta(a.Trigger))
+	case TriggerRegex:
+		re, err = regexp.Compile(a.Trigger)
+	default:
+		return nil, errors.Errorf("unknown trigger kind %s", a.Kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	responderPatterns.Lock()
+	responderPatterns.m[key] = re
+	responderPatterns.Unlock()
+	return re, nil
+}
+
+func (a AutoResponder) matches(text string) bool {
+	re, err := a.pattern()
+	if err != nil {
+		LogE.Printf("invalid auto-responder trigger %s: %s", a.Trigger, err)
+		return false
+	}
+	return re.MatchString(text)
+}
+
+// checks the message against each of the chat's auto-responders in order of
+// their kind and trigger and sends the response of the first one that matches and
+// isn't cooling down
+func runAutoResponders(m *tb.Message, chatID int64) {
+	key := fmt.Sprintf("chat:%d:autoResponders", chatID)
+	responders, err := R.HGetAll(key).Result()
+	if err != nil {
+		LogE.Printf("couldn't get auto-responders for chat %d: %s", chatID, err)
+		return
+	}
+	fields := []string{}
+	for field := range responders {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		a := DecodeAutoResponder([]byte(responders[field]))
+		if !a.matches(m.Text) {
+			continue
+		}
+		if a.Cooldown > 0 {
+			cooldownKey := fmt.Sprintf("chat:%d:autoResponderCooldown:%s", chatID, field)
+			ttl := time.Duration(a.Cooldown) * time.Second
+			// only the first match inside the cooldown window gets to set the key
+			if set, err := R.SetNX(cooldownKey, 1, ttl).Result(); err != nil || !set {
+				return
+			}
+		}
+		response, err := renderTemplate(field, a.Response, m)
+		if err != nil {
+			LogE.Printf("failed to render auto-responder %s in chat %d: %s", field, chatID, err)
+			return
+		}
+		if a.ReplyToTrigger {
+			B.Reply(m, response)
+		} else {
+			B.Send(m.Chat, response)
+		}
+		return
+	}
+}
+
+func addAutoResponder(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	if len(ms) < 5 {
+		B.Send(sender, "you need to answer every question to add an auto-responder")
+		return
+	}
+	chatID, _, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	cooldown, err := strconv.ParseInt(ms[3].Text, 10, 64)
+	if err != nil || cooldown < 0 {
+		B.Send(sender, fmt.Sprintf("The cooldown needs to be a number of seconds, \"%s\" is not", ms[3].Text))
+		return nil
+	}
+	a := AutoResponder{
+		Kind:           ms[0].Text,
+		Trigger:        ms[1].Text,
+		Response:       ms[2].Text,
+		Cooldown:       cooldown,
+		ReplyToTrigger: ms[4].Text == "Yes",
+	}
+	if _, err := a.pattern(); err != nil {
+		B.Send(sender, fmt.Sprintf("\"%s\" isn't a valid trigger: %s", a.Trigger, err))
+		return nil
+	}
+	key := fmt.Sprintf("chat:%d:autoResponders", chatID)
+	if err = R.HSet(key, a.field(), EncodeAutoResponder(&a)).Err(); err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't save auto-responder %s", a.Trigger)
+	}
+	B.Send(sender, fmt.Sprintf("added/updated auto-responder for %s \"%s\"", strings.ToLower(a.Kind), a.Trigger))
+	return
+}
+
+func removeAutoResponder(ms []*tb.Message) (err error) {
+	m := ms[0]
+	chatID, _, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		B.Send(m.Sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	key := fmt.Sprintf("chat:%d:autoResponders", chatID)
+	data, err := R.HGet(key, m.Text).Bytes()
+	if err != nil {
+		B.Send(m.Sender, fmt.Sprintf("\"%s\" isn't one of the auto-responders", m.Text))
+		return nil
+	}
+	if err = R.HDel(key, m.Text).Err(); err != nil {
+		B.Send(m.Sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't remove auto-responder %s", m.Text)
+	}
+	a := DecodeAutoResponder(data)
+	responderPatterns.Lock()
+	delete(responderPatterns.m, a.field())
+	responderPatterns.Unlock()
+	B.Send(m.Sender, fmt.Sprintf("removed auto-responder \"%s\"", m.Text))
+	return
+}
+
+func viewAutoResponders(ms []*tb.Message) (err error) {
+	m := ms[0]
+	chatID, chatTitle, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		B.Send(m.Sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	key := fmt.Sprintf("chat:%d:autoResponders", chatID)
+	responders, err := R.HGetAll(key).Result()
+	if err != nil && err != redis.Nil {
+		B.Send(m.Sender, ErrorResponse)
+		return errors.Wrapf(err, "could not access %s", key)
+	}
+	if len(responders) == 0 {
+		B.Send(m.Sender, fmt.Sprintf("%s doesn't have any auto-responders", chatTitle))
+		return
+	}
+	lines := []string{fmt.Sprintf("auto-responders for %s", chatTitle)}
+	for _, data := range responders {
+		a := DecodeAutoResponder([]byte(data))
+		line := fmt.Sprintf("%s \"%s\" (cooldown %ds", a.Kind, a.Trigger, a.Cooldown)
+		if a.ReplyToTrigger {
+			line += ", replies to trigger"
+		}
+		lines = append(lines, line+")")
+	}
+	B.Send(m.Sender, strings.Join(lines, "\n"))
+	return
+}
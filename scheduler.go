@@ -0,0 +1,560 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// how often the scheduler checks for due schedules
+const schedulerTick = 15 * time.Second
+
+// sorted set of "chatID:scheduleID" members scored by their next run
+const scheduleQueueKey = "beru:schedules"
+
+// sorted set of job IDs scored by the time they should run
+const jobQueueKey = "beru:jobs"
+
+// needs to be string constant so we can encode with gob
+// but still refer to functions, since functions can't be
+// encoded with gob
+type JobType string
+
+const (
+	JLiftRestriction JobType = "liftRestriction"
+	JDeleteMessage   JobType = "deleteMessage"
+	JCaptchaTimeout  JobType = "captchaTimeout"
+	JRemoveButtons   JobType = "removeButtons"
+	JUnlockChat      JobType = "unlockChat"
+)
+
+// a one off task that has to run at a later time, even if the bot restarts
+// in the meantime, the fields a job uses depend on its type
+type Job struct {
+	ID        string
+	Type      JobType
+	ChatID    int64
+	UserID    int
+	MessageID int
+}
+
+type JobHandler func(Job) error
+
+var JobRegistry = map[JobType]JobHandler{
+	JLiftRestriction: liftRestriction,
+	JDeleteMessage:   deleteQueuedMessage,
+	JCaptchaTimeout:  captchaTimeout,
+	JRemoveButtons:   removeQueuedButtons,
+	JUnlockChat:      unlockQueuedChat,
+}
+
+// saves the job and queues it to run at the given time
+func queueJob(j Job, at time.Time) error {
+	id, err := R.Incr("beru:jobCounter").Result()
+	if err != nil {
+		return errors.Wrap(err, "couldn't create job id")
+	}
+	j.ID = strconv.FormatInt(id, 10)
+	_, err = R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(fmt.Sprintf("beru:job:%s", j.ID), EncodeJob(&j), 0)
+		pipe.ZAdd(jobQueueKey, redis.Z{Score: float64(at.Unix()), Member: j.ID})
+		return nil
+	})
+	return errors.Wrapf(err, "couldn't queue %s job", j.Type)
+}
+
+// deletes a message beru sent once it has been up for a while
+func deleteMessageLater(m *tb.Message, after time.Duration) {
+	err := queueJob(Job{Type: JDeleteMessage, ChatID: m.Chat.ID, MessageID: m.ID}, time.Now().Add(after))
+	if err != nil {
+		LogE.Printf("message %d in chat %d won't be deleted: %s", m.ID, m.Chat.ID, err)
+	}
+}
+
+func deleteQueuedMessage(j Job) error {
+	err := B.Delete(&tb.Message{ID: j.MessageID, Chat: &tb.Chat{ID: j.ChatID}})
+	return errors.Wrapf(err, "couldn't delete message %d in chat %d", j.MessageID, j.ChatID)
+}
+
+// removes the inline buttons from a message beru sent
+func removeQueuedButtons(j Job) error {
+	_, err := B.EditReplyMarkup(&tb.Message{ID: j.MessageID, Chat: &tb.Chat{ID: j.ChatID}}, nil)
+	return errors.Wrapf(err, "couldn't remove buttons from message %d in chat %d", j.MessageID, j.ChatID)
+}
+
+func runDueJobs(now time.Time) {
+	due, err := R.ZRangeByScore(jobQueueKey, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Unix(), 10),
+	}).Result()
+	if err != nil {
+		LogE.Printf("couldn't get due jobs: %s", err)
+		return
+	}
+	for _, id := range due {
+		// removing the job from the queue claims it for this instance
+		if claimed, _ := R.ZRem(jobQueueKey, id).Result(); claimed == 0 {
+			continue
+		}
+		key := fmt.Sprintf("beru:job:%s", id)
+		data, err := R.Get(key).Bytes()
+		if err != nil {
+			LogW.Printf("dropping queued job %s: %s", id, err)
+			continue
+		}
+		R.Del(key)
+		j := DecodeJob(data)
+		if handler, ok := JobRegistry[j.Type]; !ok {
+			LogE.Printf("job type not found in registry: %s", j.Type)
+		} else if err := handler(j); err != nil {
+			LogE.Printf("%s job %s failed: %s", j.Type, j.ID, err)
+		}
+	}
+}
+
+// a message posted to a chat on a recurring schedule
+type Schedule struct {
+	ID     string
+	ChatID int64
+	// either "every <duration>" or a five field cron expression in UTC
+	Spec string
+	// template rendered with a ScheduleContext each time it is posted
+	Text      string
+	ParseMode string
+	Paused    bool
+	CreatedBy int
+}
+
+// the values available to a schedule's template
+type ScheduleContext struct {
+	ChatTitle string
+	Time      time.Time
+}
+
+func (s Schedule) member() string {
+	return fmt.Sprintf("%d:%s", s.ChatID, s.ID)
+}
+
+func (s Schedule) String() string {
+	return fmt.Sprintf("#%s %s", s.ID, s.Spec)
+}
+
+// the schedule ID at the start of a label made by String
+func scheduleIDOf(label string) string {
+	fields := strings.Fields(label)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(fields[0], "#")
+}
+
+// anything that can work out when a schedule runs next
+type Timetable interface {
+	Next(after time.Time) time.Time
+}
+
+type intervalTimetable time.Duration
+
+func (t intervalTimetable) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(t))
+}
+
+// the values each cron field matches, indexed by the value itself
+type cronTimetable struct {
+	minute, hour, dom, month, dow []bool
+	// day of month and day of week match either one when both are restricted
+	domAny, dowAny bool
+}
+
+func (t cronTimetable) dayMatches(d time.Time) bool {
+	domOk, dowOk := t.dom[d.Day()], t.dow[int(d.Weekday())]
+	if t.domAny || t.dowAny {
+		return domOk && dowOk
+	}
+	return domOk || dowOk
+}
+
+func (t cronTimetable) Next(after time.Time) time.Time {
+	next := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	// give up after a few years so a date that never exists (feb 30th) can't loop forever
+	limit := next.AddDate(5, 0, 0)
+	for next.Before(limit) {
+		if !t.month[int(next.Month())] {
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !t.dayMatches(next) {
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !t.hour[next.Hour()] {
+			next = next.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if !t.minute[next.Minute()] {
+			next = next.Add(time.Minute)
+			continue
+		}
+		return next
+	}
+	return time.Time{}
+}
+
+// parses a single cron field such as *, */15, 1-5, 0,30 or 9
+func parseCronField(field string, min int, max int) ([]bool, error) {
+	values := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return nil, errors.Errorf("invalid step in %s", part)
+			}
+			step, part = s, part[:i]
+		}
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, errors.Errorf("invalid value %s", part)
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, errors.Errorf("invalid range %s", part)
+				}
+			} else if step > 1 {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return nil, errors.Errorf("%s is outside of %d-%d", part, min, max)
+		}
+		for v := start; v <= end; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+func parseTimetable(spec string) (Timetable, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(strings.ToLower(spec), "every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("every "):]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid interval")
+		}
+		if d < time.Minute {
+			return nil, errors.New("the interval has to be at least a minute")
+		}
+		return intervalTimetable(d), nil
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expressions need five fields: minute hour day-of-month month day-of-week")
+	}
+	t := cronTimetable{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var err error
+	if t.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, errors.Wrap(err, "minute")
+	}
+	if t.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, errors.Wrap(err, "hour")
+	}
+	if t.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, errors.Wrap(err, "day of month")
+	}
+	if t.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, errors.Wrap(err, "month")
+	}
+	// 7 is accepted as sunday along with 0
+	if t.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, errors.Wrap(err, "day of week")
+	}
+	t.dow[0] = t.dow[0] || t.dow[7]
+	if t.Next(time.Now()).IsZero() {
+		return nil, errors.New("that cron expression never runs")
+	}
+	return t, nil
+}
+
+func getSchedule(chatID int64, id string) (Schedule, error) {
+	key := fmt.Sprintf("chat:%d:schedules", chatID)
+	data, err := R.HGet(key, id).Bytes()
+	if err != nil {
+		return Schedule{}, errors.Wrapf(err, "couldn't get schedule %s for chat %d", id, chatID)
+	}
+	return DecodeSchedule(data), nil
+}
+
+func getSchedules(chatID int64) ([]Schedule, error) {
+	key := fmt.Sprintf("chat:%d:schedules", chatID)
+	data, err := R.HGetAll(key).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "could not access %s", key)
+	}
+	schedules := []Schedule{}
+	for _, d := range data {
+		schedules = append(schedules, DecodeSchedule([]byte(d)))
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		a, _ := strconv.Atoi(schedules[i].ID)
+		b, _ := strconv.Atoi(schedules[j].ID)
+		return a < b
+	})
+	return schedules, nil
+}
+
+// saves the schedule and queues its next run, or takes it off the queue if paused
+func saveSchedule(s Schedule) error {
+	key := fmt.Sprintf("chat:%d:schedules", s.ChatID)
+	_, err := R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(key, s.ID, EncodeSchedule(&s))
+		if s.Paused {
+			pipe.ZRem(scheduleQueueKey, s.member())
+		} else if next := nextRun(s, time.Now()); !next.IsZero() {
+			pipe.ZAdd(scheduleQueueKey, redis.Z{Score: float64(next.Unix()), Member: s.member()})
+		}
+		return nil
+	})
+	return err
+}
+
+func deleteSchedule(chatID int64, id string) error {
+	key := fmt.Sprintf("chat:%d:schedules", chatID)
+	_, err := R.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HDel(key, id)
+		pipe.ZRem(scheduleQueueKey, fmt.Sprintf("%d:%s", chatID, id))
+		return nil
+	})
+	return err
+}
+
+func nextRun(s Schedule, after time.Time) time.Time {
+	t, err := parseTimetable(s.Spec)
+	if err != nil {
+		LogE.Printf("schedule %s in chat %d has an invalid spec: %s", s.ID, s.ChatID, err)
+		return time.Time{}
+	}
+	return t.Next(after)
+}
+
+// puts every active schedule back on the queue in case the bot stopped
+// between claiming a schedule and queueing its next run
+func restoreSchedules() {
+	chats, err := R.SMembers("beru:chats").Result()
+	if err != nil {
+		LogE.Printf("couldn't get chats to restore schedules: %s", err)
+		return
+	}
+	for _, c := range chats {
+		chatID, _ := strconv.ParseInt(c, 10, 64)
+		schedules, err := getSchedules(chatID)
+		if err != nil {
+			LogE.Print(err)
+			continue
+		}
+		for _, s := range schedules {
+			if s.Paused {
+				continue
+			}
+			if next := nextRun(s, time.Now()); !next.IsZero() {
+				R.ZAddNX(scheduleQueueKey, redis.Z{Score: float64(next.Unix()), Member: s.member()})
+			}
+		}
+	}
+}
+
+// polls the queues for due schedules and jobs and starts or ends night
+// modes until the bot stops
+func runScheduler() {
+	restoreSchedules()
+	for range time.Tick(schedulerTick) {
+		runDueSchedules(time.Now())
+		runDueJobs(time.Now())
+		runNightModes(time.Now())
+	}
+}
+
+func runDueSchedules(now time.Time) {
+	due, err := R.ZRangeByScoreWithScores(scheduleQueueKey, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Unix(), 10),
+	}).Result()
+	if err != nil {
+		LogE.Printf("couldn't get due schedules: %s", err)
+		return
+	}
+	for _, z := range due {
+		member := z.Member.(string)
+		// removing the member claims the run, so when several instances
+		// are polling only one of them posts the message
+		if claimed, _ := R.ZRem(scheduleQueueKey, member).Result(); claimed == 0 {
+			continue
+		}
+		split := strings.SplitN(member, ":", 2)
+		chatID, _ := strconv.ParseInt(split[0], 10, 64)
+		s, err := getSchedule(chatID, split[len(split)-1])
+		if err != nil {
+			LogW.Printf("dropping queued schedule %s: %s", member, err)
+			continue
+		}
+		if s.Paused {
+			continue
+		}
+		postSchedule(s, now)
+		// intervals count from when the run was due rather than when the tick
+		// picked it up so they don't drift, unless the bot was down long enough
+		// to miss runs
+		next := nextRun(s, time.Unix(int64(z.Score), 0))
+		if !next.After(now) {
+			next = nextRun(s, now)
+		}
+		if !next.IsZero() {
+			R.ZAdd(scheduleQueueKey, redis.Z{Score: float64(next.Unix()), Member: member})
+		}
+	}
+}
+
+func postSchedule(s Schedule, now time.Time) {
+	title, _ := getChatTitle(int(s.ChatID))
+	text, err := renderTemplateFor("schedule", s.Text, ScheduleContext{ChatTitle: title, Time: now.UTC()}, s.ParseMode)
+	if err != nil {
+		LogE.Printf("failed to render schedule %s in chat %d: %s", s.ID, s.ChatID, err)
+		return
+	}
+	if _, err := B.Send(&tb.Chat{ID: s.ChatID}, text, parseModeFor(s.ParseMode)); err != nil {
+		LogE.Printf("failed to post schedule %s in chat %d: %s", s.ID, s.ChatID, err)
+	}
+}
+
+// receives the schedule spec, parse mode and message
+func addSchedule(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	if len(ms) < 3 {
+		B.Send(sender, "you need to answer every question to add a scheduled message")
+		return
+	}
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	s := Schedule{
+		ChatID:    int64(chatID),
+		Spec:      strings.TrimSpace(ms[0].Text),
+		ParseMode: ms[1].Text,
+		Text:      ms[2].Text,
+		CreatedBy: sender.ID,
+	}
+	t, err := parseTimetable(s.Spec)
+	if err != nil {
+		B.Send(sender, fmt.Sprintf("\"%s\" isn't a valid schedule: %s", s.Spec, err))
+		return nil
+	}
+	if err = validateFormatting(s.Text, s.ParseMode); err != nil {
+		B.Send(sender, fmt.Sprintf("The message isn't valid %s: %s", s.ParseMode, err))
+		return nil
+	}
+	if _, err = renderTemplate("schedule", s.Text, ScheduleContext{}); err != nil {
+		B.Send(sender, fmt.Sprintf("The message isn't a valid template: %s", errors.Cause(err)))
+		return nil
+	}
+	id, err := R.Incr(fmt.Sprintf("chat:%d:scheduleCounter", chatID)).Result()
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't create schedule id")
+	}
+	s.ID = strconv.FormatInt(id, 10)
+	if err = saveSchedule(s); err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't save schedule for chat %d", chatID)
+	}
+	next := t.Next(time.Now()).UTC().Format("Mon Jan 2 15:04 MST")
+	B.Send(sender, fmt.Sprintf("Scheduled message %s added to %s, it will first be posted %s", s, chatTitle, next))
+	return
+}
+
+func viewSchedules(ms []*tb.Message) (err error) {
+	m := ms[0]
+	chatID, chatTitle, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		B.Send(m.Sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	schedules, err := getSchedules(int64(chatID))
+	if err != nil {
+		B.Send(m.Sender, ErrorResponse)
+		return
+	}
+	if len(schedules) == 0 {
+		B.Send(m.Sender, fmt.Sprintf("%s doesn't have any scheduled messages", chatTitle))
+		return
+	}
+	lines := []string{fmt.Sprintf("scheduled messages for %s", chatTitle)}
+	for _, s := range schedules {
+		state := "next " + nextRun(s, time.Now()).UTC().Format("Mon Jan 2 15:04 MST")
+		if s.Paused {
+			state = "paused"
+		}
+		preview := []rune(s.Text)
+		if len(preview) > 40 {
+			preview = append(preview[:40], []rune("...")...)
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s): %s", s, state, string(preview)))
+	}
+	B.Send(m.Sender, strings.Join(lines, "\n"))
+	return
+}
+
+func toggleSchedule(ms []*tb.Message) (err error) {
+	m := ms[0]
+	chatID, _, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		B.Send(m.Sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	s, err := getSchedule(int64(chatID), scheduleIDOf(m.Text))
+	if err != nil {
+		B.Send(m.Sender, "I couldn't find that scheduled message")
+		return nil
+	}
+	s.Paused = !s.Paused
+	if err = saveSchedule(s); err != nil {
+		B.Send(m.Sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't save schedule %s", s.ID)
+	}
+	state := "resumed"
+	if s.Paused {
+		state = "paused"
+	}
+	B.Send(m.Sender, fmt.Sprintf("Scheduled message %s has been %s", s, state))
+	return
+}
+
+func removeSchedule(ms []*tb.Message) (err error) {
+	m := ms[0]
+	chatID, _, err := getUsersActiveChat(m.Sender.ID)
+	if err != nil {
+		B.Send(m.Sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	s, err := getSchedule(int64(chatID), scheduleIDOf(m.Text))
+	if err != nil {
+		B.Send(m.Sender, "I couldn't find that scheduled message")
+		return nil
+	}
+	if err = deleteSchedule(s.ChatID, s.ID); err != nil {
+		B.Send(m.Sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't remove schedule %s", s.ID)
+	}
+	B.Send(m.Sender, fmt.Sprintf("Scheduled message #%s has been removed", s.ID))
+	return
+}
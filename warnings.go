@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// a warning given to a user by an admin or one of beru's filters
+type Warning struct {
+	Reason     string
+	IssuedBy   int
+	IssuerName string
+	Time       int64
+	// unix time the warning stops counting, 0 if it never does
+	Expires int64
+}
+
+func (w Warning) String() string {
+	s := fmt.Sprintf("%s by %s", time.Unix(w.Time, 0).UTC().Format("Jan 2 15:04 MST"), w.IssuerName)
+	if w.Reason != "" {
+		s += ": " + w.Reason
+	}
+	return s
+}
+
+// how many warnings lead to each action, 0 turns an action off
+type WarnSettings struct {
+	ExpiryHours int
+	MuteAt      int
+	MuteMinutes int
+	KickAt      int
+	BanAt       int
+	// whether beru's own filters warn the users they catch
+	Filters bool
+}
+
+func getWarnSettings(chatID int64) WarnSettings {
+	settings, _ := R.HGetAll(fmt.Sprintf("chat:%d:warnSettings", chatID)).Result()
+	s := WarnSettings{Filters: settings["filters"] == "Yes"}
+	s.ExpiryHours, _ = strconv.Atoi(settings["expiryHours"])
+	s.MuteAt, _ = strconv.Atoi(settings["muteAt"])
+	s.MuteMinutes, _ = strconv.Atoi(settings["muteMinutes"])
+	s.KickAt, _ = strconv.Atoi(settings["kickAt"])
+	s.BanAt, _ = strconv.Atoi(settings["banAt"])
+	return s
+}
+
+func warningsKey(chatID int64, userID int) string {
+	return fmt.Sprintf("chat:%d:warnings:%d", chatID, userID)
+}
+
+// the user's warnings that haven't expired, oldest first
+func getWarnings(chatID int64, userID int) ([]Warning, error) {
+	key := warningsKey(chatID, userID)
+	data, err := R.LRange(key, 0, -1).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't get warnings for user %d in chat %d", userID, chatID)
+	}
+	now := time.Now().Unix()
+	warnings := []Warning{}
+	for _, d := range data {
+		w := DecodeWarning([]byte(d))
+		if w.Expires != 0 && w.Expires <= now {
+			R.LRem(key, 1, d)
+			continue
+		}
+		warnings = append(warnings, w)
+	}
+	return warnings, nil
+}
+
+// warns the user and takes whichever action the chat has set for the number
+// of warnings they now have, the issuer is nil when one of beru's filters warns them
+func issueWarning(chat *tb.Chat, u *tb.User, reason string, issuer *tb.User) (int, error) {
+	s := getWarnSettings(chat.ID)
+	w := Warning{Reason: reason, IssuerName: "Beru", Time: time.Now().Unix()}
+	if issuer != nil {
+		w.IssuedBy, w.IssuerName = issuer.ID, displayName(issuer)
+	}
+	expiry := time.Duration(s.ExpiryHours) * time.Hour
+	if expiry > 0 {
+		w.Expires = time.Now().Add(expiry).Unix()
+	}
+	key := warningsKey(chat.ID, u.ID)
+	if err := R.RPush(key, EncodeWarning(&w)).Err(); err != nil {
+		return 0, errors.Wrapf(err, "couldn't warn user %d in chat %d", u.ID, chat.ID)
+	}
+	if expiry > 0 {
+		// every older warning expires before the newest one
+		R.Expire(key, expiry)
+	}
+	warnings, err := getWarnings(chat.ID, u.ID)
+	if err != nil {
+		return 0, err
+	}
+	count := len(warnings)
+	audit(AuditEntry{ChatID: chat.ID, Action: AuditWarn, Reason: strings.TrimSpace(fmt.Sprintf("%s (warning %d)", reason, count))}.by(issuer).against(u))
+	entry := AuditEntry{ChatID: chat.ID, Reason: fmt.Sprintf("%d warnings", count)}.against(u)
+	msg := fmt.Sprintf("%s has been warned (%d)", displayName(u), count)
+	if reason != "" {
+		msg += ": " + reason
+	}
+	switch {
+	case s.BanAt > 0 && count >= s.BanAt:
+		err = B.Ban(chat, &tb.ChatMember{User: u, RestrictedUntil: tb.Forever()})
+		R.Del(key)
+		msg += fmt.Sprintf("\nThat's %d warnings, they've been banned", count)
+		entry.Action = AuditBan
+	case s.KickAt > 0 && count >= s.KickAt:
+		err = kickMember(chat, u)
+		// they can join again, so they start again from no warnings
+		R.Del(key)
+		msg += fmt.Sprintf("\nThat's %d warnings, they've been removed from the chat", count)
+		entry.Action = AuditKick
+	case s.MuteAt > 0 && count >= s.MuteAt && s.MuteMinutes > 0:
+		until := time.Now().Add(time.Duration(s.MuteMinutes) * time.Minute)
+		err = muteMember(chat, u, until.Unix())
+		msg += fmt.Sprintf("\nThat's %d warnings, they've been muted for %d minutes", count, s.MuteMinutes)
+		entry.Action = AuditMute
+	}
+	if entry.Action != "" {
+		audit(entry)
+	}
+	if entry.Action == AuditBan {
+		propagateBan(chat, u, entry.Reason)
+	}
+	if err != nil {
+		LogE.Printf("couldn't act on %d warnings for user %d in chat %d: %s", count, u.ID, chat.ID, err)
+	}
+	B.Send(chat, msg)
+	return count, nil
+}
+
+// lets one of beru's filters warn the user if the chat has turned that on
+func warnFromFilter(m *tb.Message, reason string) {
+	if !getWarnSettings(m.Chat.ID).Filters || isKnownAdmin(m.Chat.ID, m.Sender.ID) {
+		return
+	}
+	if _, err := issueWarning(m.Chat, m.Sender, reason, nil); err != nil {
+		LogE.Print(err)
+	}
+}
+
+// /warn as a reply or with a username, followed by an optional reason
+func warnUser(m *tb.Message) {
+	u, reason, err := targetOf(m)
+	if err != nil {
+		B.Reply(m, "Who should be warned? "+err.Error())
+		return
+	}
+	if u.IsBot || isKnownAdmin(m.Chat.ID, u.ID) {
+		B.Reply(m, "Admins and bots can't be warned")
+		return
+	}
+	if _, err := issueWarning(m.Chat, u, reason, m.Sender); err != nil {
+		LogE.Print(err)
+		B.Reply(m, ErrorResponse)
+	}
+}
+
+// removes the user's most recent warning
+func unwarnUser(m *tb.Message) {
+	u, _, err := targetOf(m)
+	if err != nil {
+		B.Reply(m, "Whose warning should be removed? "+err.Error())
+		return
+	}
+	if _, err := R.RPop(warningsKey(m.Chat.ID, u.ID)).Result(); err != nil {
+		B.Reply(m, displayName(u)+" doesn't have any warnings")
+		return
+	}
+	warnings, _ := getWarnings(m.Chat.ID, u.ID)
+	audit(AuditEntry{ChatID: m.Chat.ID, Action: AuditUnwarn, Reason: fmt.Sprintf("last warning removed, %d left", len(warnings)),
+		Link: messageLink(m)}.by(m.Sender).against(u))
+	B.Reply(m, fmt.Sprintf("Removed the last warning for %s, they have %d left", displayName(u), len(warnings)))
+}
+
+func viewWarnings(m *tb.Message) {
+	u, _, err := targetOf(m)
+	if err != nil {
+		B.Reply(m, "Whose warnings do you want to see? "+err.Error())
+		return
+	}
+	warnings, err := getWarnings(m.Chat.ID, u.ID)
+	if err != nil {
+		LogE.Print(err)
+		B.Reply(m, ErrorResponse)
+		return
+	}
+	if len(warnings) == 0 {
+		B.Reply(m, displayName(u)+" doesn't have any warnings")
+		return
+	}
+	lines := []string{fmt.Sprintf("%s has %d warnings", displayName(u), len(warnings))}
+	for i, w := range warnings {
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, w))
+	}
+	B.Reply(m, strings.Join(lines, "\n"))
+}
+
+func resetWarnings(m *tb.Message) {
+	u, _, err := targetOf(m)
+	if err != nil {
+		B.Reply(m, "Whose warnings should be reset? "+err.Error())
+		return
+	}
+	removed, err := R.Del(warningsKey(m.Chat.ID, u.ID)).Result()
+	if err != nil {
+		LogE.Print(err)
+		B.Reply(m, ErrorResponse)
+		return
+	}
+	if removed == 0 {
+		B.Reply(m, displayName(u)+" doesn't have any warnings")
+		return
+	}
+	audit(AuditEntry{ChatID: m.Chat.ID, Action: AuditUnwarn, Reason: "all warnings reset",
+		Link: messageLink(m)}.by(m.Sender).against(u))
+	B.Reply(m, "Warnings for "+displayName(u)+" have been reset")
+}
+
+// receives the expiry, mute threshold, mute minutes, kick threshold,
+// ban threshold and whether filters issue warnings
+func setWarnings(ms []*tb.Message) (err error) {
+	sender := ms[0].Sender
+	chatID, chatTitle, err := getUsersActiveChat(sender.ID)
+	if err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrap(err, "couldn't get active chat")
+	}
+	names := []string{"expiry", "mute threshold", "mute time", "kick threshold", "ban threshold"}
+	fields := []string{"expiryHours", "muteAt", "muteMinutes", "kickAt", "banAt"}
+	settings := map[string]interface{}{}
+	for i, name := range names {
+		v, err := strconv.Atoi(ms[i].Text)
+		if err != nil || v < 0 {
+			B.Send(sender, fmt.Sprintf("Warning settings weren't saved, the %s needs to be a number", name))
+			return nil
+		}
+		settings[fields[i]] = v
+	}
+	if settings["muteAt"] != 0 && settings["muteMinutes"] == 0 {
+		B.Send(sender, "Warning settings weren't saved, a mute threshold needs a mute time longer than 0 minutes")
+		return
+	}
+	filters := ms[5].Text
+	if filters != "Yes" && filters != "No" {
+		B.Send(sender, "Warning settings weren't saved, answer Yes or No for filters")
+		return
+	}
+	settings["filters"] = filters
+	if err = R.HMSet(fmt.Sprintf("chat:%d:warnSettings", chatID), settings).Err(); err != nil {
+		B.Send(sender, ErrorResponse)
+		return errors.Wrapf(err, "couldn't save warning settings for chat %d", chatID)
+	}
+	B.Send(sender, fmt.Sprintf("Warning settings for %s have been saved, admins can use /warn, /unwarn, "+
+		"/warnings and /resetwarns in the chat", chatTitle))
+	return
+}